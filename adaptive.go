@@ -0,0 +1,138 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"sync"
+	"time"
+)
+
+// BulkController adjusts the bulk size and the number of bulk workers
+// sending at the same time from the feedback of the target, AIMD-style:
+// grow a step after each fast and clean bulk, halve on rejections or when
+// the bulk is slower than the target latency
+type BulkController struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	minSize       int
+	maxSize       int
+	sizeStep      int
+	size          int
+	minWorkers    int
+	maxWorkers    int
+	workers       int
+	active        int
+	targetLatency time.Duration
+
+	//bulk requests started before the last decrease don't decrease again
+	epoch int
+}
+
+func NewBulkController(c *Config) *BulkController {
+	maxSize := c.BulkSizeInMB * 1024 * 1024
+	minSize := c.AdaptiveMinBulkSizeInMB * 1024 * 1024
+	if minSize <= 0 || minSize > maxSize {
+		minSize = maxSize
+	}
+	minWorkers := c.AdaptiveMinWorkers
+	if minWorkers < 1 || minWorkers > c.Workers {
+		minWorkers = c.Workers
+	}
+
+	b := &BulkController{
+		minSize:       minSize,
+		maxSize:       maxSize,
+		sizeStep:      minSize,
+		size:          minSize,
+		minWorkers:    minWorkers,
+		maxWorkers:    c.Workers,
+		workers:       minWorkers,
+		targetLatency: time.Duration(c.AdaptiveTargetLatency) * time.Millisecond,
+	}
+	b.cond = sync.NewCond(&b.lock)
+	log.Infof("adaptive bulk, size: %d-%d bytes, workers: %d-%d, target latency: %s",
+		minSize, maxSize, minWorkers, c.Workers, b.targetLatency)
+	return b
+}
+
+// BulkSize is the size a worker should flush its buffer at
+func (b *BulkController) BulkSize() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.size
+}
+
+// Acquire waits until the worker may send a bulk request
+func (b *BulkController) Acquire() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.active >= b.workers {
+		b.cond.Wait()
+	}
+	b.active++
+	return b.epoch
+}
+
+// Release reports the outcome of a bulk request started at epoch
+func (b *BulkController) Release(epoch int, latency time.Duration, result *BulkResult, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.active--
+	defer b.cond.Broadcast()
+
+	rejected := 0
+	if result != nil {
+		rejected = result.Retried
+	}
+
+	if err != nil || rejected > 0 || latency > b.targetLatency {
+		if epoch != b.epoch {
+			return
+		}
+		b.epoch++
+		size := b.size / 2
+		if size < b.minSize {
+			size = b.minSize
+		}
+		workers := b.workers / 2
+		if workers < b.minWorkers {
+			workers = b.minWorkers
+		}
+		if size != b.size || workers != b.workers {
+			log.Infof("adaptive bulk, decrease bulk size: %d => %d bytes, workers: %d => %d, latency: %s, rejected: %d, error: %v",
+				b.size, size, b.workers, workers, latency, rejected, err)
+			b.size = size
+			b.workers = workers
+		}
+		return
+	}
+
+	//grow the bulk size first, then the workers
+	if b.size < b.maxSize {
+		size := b.size + b.sizeStep
+		if size > b.maxSize {
+			size = b.maxSize
+		}
+		log.Infof("adaptive bulk, increase bulk size: %d => %d bytes, latency: %s", b.size, size, latency)
+		b.size = size
+	} else if b.workers < b.maxWorkers {
+		log.Infof("adaptive bulk, increase workers: %d => %d, latency: %s", b.workers, b.workers+1, latency)
+		b.workers++
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+func newTestController() *BulkController {
+	return NewBulkController(&Config{BulkSizeInMB: 4, AdaptiveMinBulkSizeInMB: 1, Workers: 3, AdaptiveMinWorkers: 1,
+		AdaptiveTargetLatency: 1000})
+}
+
+func TestBulkControllerAIMD(t *testing.T) {
+	fast, slow := 10*time.Millisecond, 2*time.Second
+	steps := []struct {
+		name    string
+		latency time.Duration
+		result  *BulkResult
+		err     error
+		size    int
+		workers int
+	}{
+		{"grow the size", fast, &BulkResult{}, nil, 2 * mb, 1},
+		{"grow the size again", fast, &BulkResult{}, nil, 3 * mb, 1},
+		{"size at max", fast, &BulkResult{}, nil, 4 * mb, 1},
+		{"then the workers", fast, &BulkResult{}, nil, 4 * mb, 2},
+		{"workers at max", fast, &BulkResult{}, nil, 4 * mb, 3},
+		{"both at max", fast, &BulkResult{}, nil, 4 * mb, 3},
+		{"slow halves", slow, &BulkResult{}, nil, 2 * mb, 1},
+		{"grow from half", fast, &BulkResult{}, nil, 3 * mb, 1},
+		{"rejections halve", fast, &BulkResult{Retried: 5}, nil, 3 * mb / 2, 1},
+		{"errors stay at the min", fast, nil, errors.New("unavailable"), 1 * mb, 1},
+	}
+	b := newTestController()
+	if b.BulkSize() != mb || b.workers != 1 {
+		t.Fatalf("starts at %d bytes and %d workers, want the min", b.BulkSize(), b.workers)
+	}
+	for _, s := range steps {
+		epoch := b.Acquire()
+		b.Release(epoch, s.latency, s.result, s.err)
+		if b.BulkSize() != s.size || b.workers != s.workers {
+			t.Fatalf("%s: got %d bytes and %d workers, want %d and %d", s.name, b.BulkSize(), b.workers, s.size, s.workers)
+		}
+	}
+}
+
+func TestBulkControllerDecreaseOnce(t *testing.T) {
+	b := newTestController()
+	for i := 0; i < 5; i++ {
+		b.Release(b.Acquire(), 0, &BulkResult{}, nil)
+	}
+	if b.BulkSize() != 4*mb || b.workers != 3 {
+		t.Fatalf("got %d bytes and %d workers, want the max", b.BulkSize(), b.workers)
+	}
+
+	//bulks sent at the same time all see the same pressure
+	epochs := []int{b.Acquire(), b.Acquire(), b.Acquire()}
+	for _, epoch := range epochs {
+		b.Release(epoch, 0, &BulkResult{Retried: 1}, nil)
+	}
+	if b.BulkSize() != 2*mb || b.workers != 1 {
+		t.Errorf("got %d bytes and %d workers, want a single halving", b.BulkSize(), b.workers)
+	}
+}
+
+func TestBulkControllerAcquire(t *testing.T) {
+	b := newTestController()
+	epoch := b.Acquire()
+	acquired := make(chan int)
+	go func() {
+		acquired <- b.Acquire()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second bulk was sent with a single worker")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Release(epoch, 0, &BulkResult{}, nil)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the released worker was not given to the waiting bulk")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// bulkItem is one action of a bulk request, with its source line if the
+// action carries one (everything but delete)
+type bulkItem struct {
+	op     string
+	action []byte
+	source []byte
+}
+
+// parseBulkItems splits a bulk body back into its actions, in request order,
+// so that the items of the bulk response can be matched against them
+func parseBulkItems(data []byte) ([]bulkItem, error) {
+	items := []bulkItem{}
+	lines := bytes.Split(data, []byte{'\n'})
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		action := map[string]json.RawMessage{}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, fmt.Errorf("invalid bulk action line: %s", SubString(string(line), 0, 200))
+		}
+		item := bulkItem{action: line}
+		for op := range action {
+			item.op = op
+		}
+		if item.op != "delete" {
+			//the source line follows the action line
+			for i++; i < len(lines); i++ {
+				if source := bytes.TrimSpace(lines[i]); len(source) > 0 {
+					item.source = source
+					break
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (item *bulkItem) writeTo(buf *bytes.Buffer) {
+	buf.Write(item.action)
+	buf.WriteByte('\n')
+	if item.source != nil {
+		buf.Write(item.source)
+		buf.WriteByte('\n')
+	}
+}
+
+func (item *bulkItem) failure(status int, errType string, reason string) BulkFailure {
+	failure := BulkFailure{Op: item.op, Status: status, Type: errType, Reason: reason}
+	meta := map[string]Document{}
+	if err := json.Unmarshal(item.action, &meta); err == nil {
+		failure.Doc = meta[item.op]
+	}
+	failure.Doc.Source = item.source
+	return failure
+}
+
+// idempotentBulk tells whether the bulk can be sent again without harm: all
+// its documents have an id, written again they replace themselves
+func idempotentBulk(payload []byte) bool {
+	items, err := parseBulkItems(payload)
+	if err != nil {
+		return false
+	}
+	for i := range items {
+		meta := map[string]Document{}
+		if err := json.Unmarshal(items[i].action, &meta); err != nil || len(meta[items[i].op].Id) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// failBulkItems counts all the items of the payload as failed, when the
+// response can not tell which of them made it
+func failBulkItems(result *BulkResult, payload []byte, errType string, err error) {
+	items, _ := parseBulkItems(payload)
+	for i := range items {
+		result.Failed = append(result.Failed, items[i].failure(0, errType, err.Error()))
+	}
+}
+
+// isRetriableBulkItem tells whether an item rejected by the target may succeed
+// if it is sent again later, ie: the bulk queue of the node was full
+func isRetriableBulkItem(action *Action) bool {
+	if action.Status == 429 || action.Status == 503 {
+		return true
+	}
+	return action.ErrorType() == "es_rejected_execution_exception"
+}
+
+func (a *Action) ErrorType() string {
+	if e, ok := a.Error.(map[string]interface{}); ok {
+		if t, ok := e["type"].(string); ok {
+			return t
+		}
+	}
+	return ""
+}
+
+func (a *Action) ErrorReason() string {
+	switch e := a.Error.(type) {
+	case nil:
+		return ""
+	case string:
+		//es 1.x returns the error as a plain string
+		return e
+	case map[string]interface{}:
+		if r, ok := e["reason"].(string); ok {
+			return r
+		}
+	}
+	reason, _ := json.Marshal(a.Error)
+	return string(reason)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBulkItems(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		ops     []string
+		sources []string
+		err     bool
+	}{
+		{name: "empty", payload: "", ops: []string{}, sources: []string{}},
+		{name: "index and delete",
+			payload: "{\"index\":{\"_id\":\"1\"}}\n{\"a\":1}\n{\"delete\":{\"_id\":\"2\"}}\n{\"create\":{\"_id\":\"3\"}}\n{\"a\":3}\n",
+			ops:     []string{"index", "delete", "create"}, sources: []string{`{"a":1}`, "", `{"a":3}`}},
+		{name: "delete last without newline",
+			payload: "{\"update\":{\"_id\":\"1\"}}\n{\"doc\":{\"a\":1}}\n{\"delete\":{\"_id\":\"2\"}}",
+			ops:     []string{"update", "delete"}, sources: []string{`{"doc":{"a":1}}`, ""}},
+		{name: "blank lines",
+			payload: "\n  \n{\"index\":{\"_id\":\"1\"}}\n\n{\"a\":1}\n\n\n{\"delete\":{\"_id\":\"2\"}}\n\n",
+			ops:     []string{"index", "delete"}, sources: []string{`{"a":1}`, ""}},
+		{name: "source missing", payload: "{\"index\":{\"_id\":\"1\"}}\n",
+			ops: []string{"index"}, sources: []string{""}},
+		{name: "invalid action", payload: "{\"index\":\n{\"a\":1}\n", err: true},
+		{name: "two actions in a line", payload: "{\"index\":{},\"delete\":{}}\n{\"a\":1}\n", err: true},
+		{name: "source where an action is expected", payload: "{\"delete\":{\"_id\":\"1\"}}\n[1]\n", err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			items, err := parseBulkItems([]byte(c.payload))
+			if c.err {
+				if err == nil {
+					t.Errorf("parsed %d items, want an error", len(items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != len(c.ops) {
+				t.Fatalf("parsed %d items, want %d", len(items), len(c.ops))
+			}
+			for i := range items {
+				if items[i].op != c.ops[i] || string(items[i].source) != c.sources[i] {
+					t.Errorf("item %d is %s %s, want %s %s", i, items[i].op, items[i].source, c.ops[i], c.sources[i])
+				}
+			}
+
+			//written back, the items are parsed the same
+			buf := bytes.Buffer{}
+			for i := range items {
+				items[i].writeTo(&buf)
+			}
+			again, err := parseBulkItems(buf.Bytes())
+			if err != nil || len(again) != len(items) {
+				t.Fatalf("parsed %d items back, err %v", len(again), err)
+			}
+			for i := range again {
+				if again[i].op != items[i].op || !bytes.Equal(again[i].action, items[i].action) || !bytes.Equal(again[i].source, items[i].source) {
+					t.Errorf("item %d changed when written back", i)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotentBulk(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		want    bool
+	}{
+		{"ids", "{\"index\":{\"_index\":\"a\",\"_id\":\"1\"}}\n{\"a\":1}\n{\"delete\":{\"_id\":\"2\"}}\n", true},
+		{"generated id", "{\"index\":{\"_id\":\"1\"}}\n{\"a\":1}\n{\"index\":{\"_index\":\"a\"}}\n{\"a\":2}\n", false},
+		{"empty id", "{\"create\":{\"_id\":\"\"}}\n{\"a\":1}\n", false},
+		{"invalid", "{\"index\":\n", false},
+	}
+	for _, c := range cases {
+		if got := idempotentBulk([]byte(c.payload)); got != c.want {
+			t.Errorf("%s: idempotent is %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFailBulkItems(t *testing.T) {
+	payload := "{\"index\":{\"_index\":\"a\",\"_type\":\"doc\",\"_id\":\"1\",\"routing\":\"r\"}}\n{\"a\":1}\n{\"delete\":{\"_index\":\"a\",\"_id\":\"2\"}}\n"
+	result := &BulkResult{}
+	failBulkItems(result, []byte(payload), "timeout", errors.New("read timeout"))
+	if len(result.Failed) != 2 {
+		t.Fatalf("failed %d items, want 2", len(result.Failed))
+	}
+	index, del := result.Failed[0], result.Failed[1]
+	if index.Op != "index" || index.Doc.Index != "a" || index.Doc.Type != "doc" || index.Doc.Id != "1" ||
+		index.Doc.Routing != "r" || string(index.Doc.Source) != `{"a":1}` || index.Type != "timeout" || index.Reason != "read timeout" {
+		t.Errorf("index failure is %+v", index)
+	}
+	if del.Op != "delete" || del.Doc.Id != "2" || del.Doc.Source != nil {
+		t.Errorf("delete failure is %+v", del)
+	}
+}
+
+func TestIsRetriableBulkItem(t *testing.T) {
+	cases := []struct {
+		name   string
+		action Action
+		want   bool
+	}{
+		{"too many requests", Action{Status: 429}, true},
+		{"unavailable", Action{Status: 503}, true},
+		{"rejected", Action{Status: 500, Error: map[string]interface{}{"type": "es_rejected_execution_exception"}}, true},
+		{"mapping", Action{Status: 400, Error: map[string]interface{}{"type": "mapper_parsing_exception"}}, false},
+		{"plain error", Action{Status: 500, Error: "RemoteTransportException[...]"}, false},
+		{"conflict", Action{Status: 409}, false},
+	}
+	for _, c := range cases {
+		if got := isRetriableBulkItem(&c.action); got != c.want {
+			t.Errorf("%s: retriable is %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBulkRetryThrottle(t *testing.T) {
+	defer func(policy RetryPolicy) { retryPolicy = policy }(retryPolicy)
+	retryPolicy.BaseDelay, retryPolicy.Jitter = time.Millisecond, 0
+
+	responses := []string{
+		`{"errors":true,"items":[{"index":{"_id":"1","status":201}},{"index":{"_id":"2","status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`,
+		`{"errors":false,"items":[{"index":{"_id":"2","status":201}}]}`,
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[requests]))
+		requests++
+	}))
+	defer server.Close()
+
+	type take struct{ docs, size int }
+	takes := []take{}
+	api := &ESAPIV0{Host: server.URL, BulkRetryThrottle: func(docs int, size int) {
+		takes = append(takes, take{docs, size})
+	}}
+	retried := "{\"index\":{\"_id\":\"2\"}}\n{\"a\":2}\n"
+	data := bytes.NewBufferString("{\"index\":{\"_id\":\"1\"}}\n{\"a\":1}\n" + retried)
+	result, err := api.Bulk(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Succeeded != 2 || result.Retried != 1 || len(result.Failed) != 0 {
+		t.Errorf("got %+v, want 2 succeeded after 1 retried", result)
+	}
+	if want := []take{{1, len(retried)}}; !reflect.DeepEqual(takes, want) {
+		t.Errorf("throttled %v, want %v", takes, want)
+	}
+}
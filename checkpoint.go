@@ -0,0 +1,230 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Checkpoint is the content of the checkpoint file: how far each slice of
+// each source index got, counting only the documents the target acknowledged
+type Checkpoint struct {
+	Sort    string                            `json:"sort,omitempty"`
+	Slices  int                               `json:"slices"`
+	Indices map[string]map[int]*SlicePosition `json:"indices"`
+}
+
+type SlicePosition struct {
+	SortValue []interface{} `json:"sort_value,omitempty"`
+	Docs      int64         `json:"docs"`
+	Done      bool          `json:"done,omitempty"`
+}
+
+type CheckpointTracker struct {
+	lock       sync.Mutex
+	fileName   string
+	checkpoint *Checkpoint
+	slices     map[string]*SliceCheckpoint
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+// SliceCheckpoint follows the batches of one slice, the position only moves
+// forward once every document of a batch and of the batches before it were
+// acknowledged, since the bulk workers finish them in any order
+type SliceCheckpoint struct {
+	tracker  *CheckpointTracker
+	position *SlicePosition
+	batches  []*scrollBatch
+	finished bool
+}
+
+type scrollBatch struct {
+	slice     *SliceCheckpoint
+	pending   int64
+	docs      int64
+	sortValue []interface{}
+}
+
+// NewCheckpointTracker starts a new checkpoint, or loads the previous one
+// from fileName if resume is set
+func NewCheckpointTracker(fileName string, sort string, slices int, resume bool) (*CheckpointTracker, error) {
+	t := &CheckpointTracker{
+		fileName: fileName,
+		slices:   map[string]*SliceCheckpoint{},
+		stop:     make(chan struct{}),
+	}
+
+	if resume && checkFileIsExist(fileName) {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		checkpoint := &Checkpoint{}
+		if err = DecodeJsonBytes(data, checkpoint); err != nil {
+			return nil, err
+		}
+		if checkpoint.Slices != slices {
+			return nil, fmt.Errorf("checkpoint was made with %d slices, can't resume with %d", checkpoint.Slices, slices)
+		}
+		if checkpoint.Sort != sort {
+			return nil, fmt.Errorf("checkpoint was made with sort field [%s], can't resume with [%s]", checkpoint.Sort, sort)
+		}
+		if checkpoint.Indices == nil {
+			checkpoint.Indices = map[string]map[int]*SlicePosition{}
+		}
+		t.checkpoint = checkpoint
+		log.Infof("resume from checkpoint %s", fileName)
+	} else {
+		if resume {
+			log.Warnf("checkpoint %s not found, start from the beginning", fileName)
+		}
+		t.checkpoint = &Checkpoint{Sort: sort, Slices: slices, Indices: map[string]map[int]*SlicePosition{}}
+	}
+	return t, nil
+}
+
+func (t *CheckpointTracker) Slice(index string, slice int) *SliceCheckpoint {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := fmt.Sprintf("%s/%d", index, slice)
+	if s, ok := t.slices[key]; ok {
+		return s
+	}
+
+	positions, ok := t.checkpoint.Indices[index]
+	if !ok {
+		positions = map[int]*SlicePosition{}
+		t.checkpoint.Indices[index] = positions
+	}
+	position, ok := positions[slice]
+	if !ok {
+		position = &SlicePosition{}
+		positions[slice] = position
+	}
+
+	s := &SliceCheckpoint{tracker: t, position: position}
+	t.slices[key] = s
+	return s
+}
+
+// Start writes the checkpoint file every interval until Stop
+func (t *CheckpointTracker) Start(interval time.Duration) {
+	t.stopped.Add(1)
+	go func() {
+		defer t.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := t.Save(); err != nil {
+					log.Error(err)
+				}
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (t *CheckpointTracker) Stop() {
+	close(t.stop)
+	t.stopped.Wait()
+	if err := t.Save(); err != nil {
+		log.Error(err)
+	}
+}
+
+func (t *CheckpointTracker) Save() error {
+	t.lock.Lock()
+	data, err := json.MarshalIndent(t.checkpoint, "", "  ")
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	//write aside and rename, a crash never leaves a truncated checkpoint
+	tmpFile := t.fileName + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.fileName)
+}
+
+// Position returns a copy of the acknowledged position of the slice
+func (s *SliceCheckpoint) Position() SlicePosition {
+	s.tracker.lock.Lock()
+	defer s.tracker.lock.Unlock()
+	return *s.position
+}
+
+func (s *SliceCheckpoint) NewBatch(docs []Document) *scrollBatch {
+	batch := &scrollBatch{
+		slice:     s,
+		pending:   int64(len(docs)),
+		docs:      int64(len(docs)),
+		sortValue: docs[len(docs)-1].Sort,
+	}
+	s.tracker.lock.Lock()
+	s.batches = append(s.batches, batch)
+	s.tracker.lock.Unlock()
+	return batch
+}
+
+// Finish marks the slice done once the remaining batches are acknowledged
+func (s *SliceCheckpoint) Finish() {
+	s.tracker.lock.Lock()
+	defer s.tracker.lock.Unlock()
+	s.finished = true
+	s.commit()
+}
+
+// commit moves the position over the leading acknowledged batches, the
+// tracker lock must be held
+func (s *SliceCheckpoint) commit() {
+	for len(s.batches) > 0 && atomic.LoadInt64(&s.batches[0].pending) == 0 {
+		batch := s.batches[0]
+		s.batches = s.batches[1:]
+		s.position.Docs += batch.docs
+		if len(batch.sortValue) > 0 {
+			s.position.SortValue = batch.sortValue
+		}
+	}
+	if s.finished && len(s.batches) == 0 {
+		s.position.Done = true
+	}
+}
+
+// Ack acknowledges one document of the batch
+func (b *scrollBatch) Ack() {
+	if b == nil {
+		return
+	}
+	if atomic.AddInt64(&b.pending, -1) == 0 {
+		b.slice.tracker.lock.Lock()
+		b.slice.commit()
+		b.slice.tracker.lock.Unlock()
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSliceCheckpointCommit(t *testing.T) {
+	cases := []struct {
+		name   string
+		sizes  []int //documents of each batch
+		acks   []int //batches acknowledged, one document each
+		finish bool
+		docs   int64
+		sort   []interface{}
+		done   bool
+	}{
+		{name: "nothing acknowledged", sizes: []int{2, 1}, docs: 0},
+		{name: "in order", sizes: []int{2, 1}, acks: []int{0, 0, 1}, docs: 3, sort: []interface{}{2}},
+		{name: "first batch only", sizes: []int{2, 1}, acks: []int{0, 0}, docs: 2, sort: []interface{}{1}},
+		{name: "half of the first batch", sizes: []int{2, 1}, acks: []int{0}, docs: 0},
+		{name: "later batch first", sizes: []int{2, 1}, acks: []int{1}, docs: 0},
+		{name: "later batch waits for the first", sizes: []int{2, 1}, acks: []int{1, 0}, docs: 0},
+		{name: "out of order", sizes: []int{2, 1, 1}, acks: []int{2, 1, 0, 0}, docs: 4, sort: []interface{}{3}},
+		{name: "gap in the middle", sizes: []int{1, 1, 1}, acks: []int{0, 2}, docs: 1, sort: []interface{}{1}},
+		{name: "finished with pending batches", sizes: []int{1, 1}, acks: []int{0}, finish: true, docs: 1, sort: []interface{}{1}},
+		{name: "finished", sizes: []int{1, 1}, acks: []int{1, 0}, finish: true, docs: 2, sort: []interface{}{2}, done: true},
+		{name: "finished without batches", finish: true, docs: 0, done: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker, err := NewCheckpointTracker(filepath.Join(t.TempDir(), "checkpoint.json"), "", 1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slice := tracker.Slice("index", 0)
+			batches := []*scrollBatch{}
+			for i, size := range c.sizes {
+				docs := make([]Document, size)
+				docs[size-1].Sort = []interface{}{i + 1}
+				batches = append(batches, slice.NewBatch(docs))
+			}
+			for _, i := range c.acks {
+				batches[i].Ack()
+			}
+			if c.finish {
+				slice.Finish()
+			}
+
+			position := slice.Position()
+			if position.Docs != c.docs || !reflect.DeepEqual(position.SortValue, c.sort) || position.Done != c.done {
+				t.Errorf("position is %d docs after %v done %v, want %d docs after %v done %v",
+					position.Docs, position.SortValue, position.Done, c.docs, c.sort, c.done)
+			}
+		})
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint.json")
+	tracker, err := NewCheckpointTracker(fileName, "created_at", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slice := tracker.Slice("index", 1)
+	slice.NewBatch([]Document{{Sort: []interface{}{"a", 10}}}).Ack()
+	if err = tracker.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := NewCheckpointTracker(fileName, "created_at", 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := resumed.Slice("index", 1).Position()
+	want := SlicePosition{SortValue: []interface{}{"a", json.Number("10")}, Docs: 1}
+	if !reflect.DeepEqual(position, want) {
+		t.Errorf("resumed at %+v, want %+v", position, want)
+	}
+	if position = resumed.Slice("index", 0).Position(); !reflect.DeepEqual(position, SlicePosition{}) {
+		t.Errorf("resumed slice 0 at %+v, want the beginning", position)
+	}
+
+	if _, err = NewCheckpointTracker(fileName, "created_at", 3, true); err == nil {
+		t.Error("resume with other slices should fail")
+	}
+	if _, err = NewCheckpointTracker(fileName, "updated_at", 2, true); err == nil {
+		t.Error("resume with another sort field should fail")
+	}
+}
+
+// bulkTarget answers every bulk with err
+type bulkTarget struct {
+	ESAPI
+	err error
+}
+
+func (t *bulkTarget) Bulk(data *bytes.Buffer) (*BulkResult, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &BulkResult{Succeeded: 1}, nil
+}
+
+func TestBulkAndAck(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		docs int64
+	}{
+		{"written", nil, 1},
+		{"failed", &HTTPStatusError{StatusCode: 400}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker, err := NewCheckpointTracker(filepath.Join(t.TempDir(), "checkpoint.json"), "ts", 1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slice := tracker.Slice("index", 0)
+			batch := slice.NewBatch([]Document{{Sort: []interface{}{1}}})
+
+			m := &Migrator{Config: &Config{}, TargetESAPI: &bulkTarget{err: c.err}}
+			m.bulkAndAck(bytes.NewBufferString("{\"index\":{\"_id\":\"1\"}}\n{}\n"), 1, []*scrollBatch{batch})
+			if docs := slice.Position().Docs; docs != c.docs {
+				t.Errorf("checkpoint at %d documents, want %d", docs, c.docs)
+			}
+			if failed := m.Err() != nil; failed != (c.err != nil) {
+				t.Errorf("run failed is %v, want %v", failed, c.err != nil)
+			}
+		})
+	}
+}
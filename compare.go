@@ -0,0 +1,280 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	CompareSource = "source"
+	CompareScript = "script"
+
+	digestField = "_esm_digest"
+)
+
+// digestScript hashes the source on the cluster, so only the digest goes
+// over the network. The source is first cut to the fields of --fields, as
+// esm writes them, the ignored fields are removed, then it is written with
+// sorted keys, a tag for the type of each value and the length of each
+// string. Integral numbers are written as integers, like canonicalJson does
+const digestScript = `def keep(def value, List paths) {
+  if (value instanceof List) {
+    List kept = new ArrayList();
+    for (def item : value) {
+      def k = keep(item, paths);
+      if (k != null) { kept.add(k); }
+    }
+    return kept.isEmpty() ? null : kept;
+  }
+  if (!(value instanceof Map)) { return null; }
+  Map kept = new HashMap();
+  for (def key : value.keySet()) {
+    boolean whole = false;
+    List sub = new ArrayList();
+    for (List path : paths) {
+      for (int i = 1; i <= path.size(); i++) {
+        if (String.join('.', path.subList(0, i)) == key) {
+          if (i == path.size()) { whole = true; } else { sub.add(path.subList(i, path.size())); }
+        }
+      }
+    }
+    if (whole) {
+      kept.put(key, value.get(key));
+    } else if (!sub.isEmpty()) {
+      def k = keep(value.get(key), sub);
+      if (k != null) { kept.put(key, k); }
+    }
+  }
+  return kept.isEmpty() ? null : kept;
+}
+void strip(def value, List path) {
+  if (value instanceof List) {
+    for (def item : value) { strip(item, path); }
+    return;
+  }
+  if (!(value instanceof Map)) { return; }
+  for (int i = path.size(); i > 0; i--) {
+    String key = String.join('.', path.subList(0, i));
+    if (value.containsKey(key)) {
+      if (i == path.size()) { value.remove(key); } else { strip(value.get(key), path.subList(i, path.size())); }
+    }
+  }
+}
+void canon(def value, StringBuilder out) {
+  if (value == null) {
+    out.append('z');
+  } else if (value instanceof Map) {
+    List keys = new ArrayList(value.keySet());
+    Collections.sort(keys);
+    out.append('{');
+    for (def key : keys) {
+      out.append(key.length() + ':' + key);
+      canon(value.get(key), out);
+    }
+    out.append('}');
+  } else if (value instanceof List) {
+    out.append('[');
+    for (def item : value) { canon(item, out); }
+    out.append(']');
+  } else if (value instanceof String) {
+    out.append('s' + value.length() + ':' + value);
+  } else if (value instanceof Boolean) {
+    out.append(value ? 't' : 'f');
+  } else if (value instanceof Integer || value instanceof Long || value instanceof Short || value instanceof Byte || value instanceof BigInteger) {
+    out.append('n' + value.toString());
+  } else if (value instanceof Number) {
+    double d = value.doubleValue();
+    if (d == Math.rint(d) && Math.abs(d) < 9007199254740992.0) {
+      out.append('n' + (long) d);
+    } else {
+      out.append('n' + Double.toString(d));
+    }
+  } else {
+    out.append('o' + value.toString());
+  }
+}
+def src = params['_source'];
+if (!params.fields.isEmpty()) {
+  src = keep(src, params.fields);
+  if (src == null) { src = new HashMap(); }
+}
+for (List path : params.ignore) { strip(src, path); }
+StringBuilder out = new StringBuilder();
+canon(src, out);
+return out.toString().sha256();`
+
+// checkCompareScript makes sure both sides run the digest script, painless
+// has sha256 since 7.0. The script cuts the source to --fields by their
+// paths, without wildcards
+func (m *Migrator) checkCompareScript() error {
+	for _, api := range []ESAPI{m.SourceESAPI, m.TargetESAPI} {
+		if major, _ := versionOf(api); major < 7 {
+			return fmt.Errorf("--compare_mode=script needs elasticsearch 7.0 or later on both sides")
+		}
+	}
+	if strings.ContainsAny(m.Config.Fields, "*?") {
+		return fmt.Errorf("--compare_mode=script can't be used with wildcards in --fields: %s", m.Config.Fields)
+	}
+	return nil
+}
+
+// digestOption asks for the digest of the documents instead of their source
+func (m *Migrator) digestOption() ScrollOption {
+	ignore := m.compareIgnore
+	if ignore == nil {
+		ignore = [][]string{}
+	}
+	return WithDigest(digestField, map[string]interface{}{
+		"lang":   "painless",
+		"source": digestScript,
+		"params": map[string]interface{}{
+			"fields": parseFieldPaths(m.Config.Fields),
+			"ignore": ignore,
+		},
+	})
+}
+
+// entryHash is the digest of the cluster, or the hash of the source. A
+// document without digest fails, the hash of its source would never match
+// the digest of the other side
+func (m *Migrator) entryHash(doc *Document) (string, error) {
+	if m.Config.CompareMode == CompareScript {
+		digest := doc.field(digestField)
+		if len(digest) == 0 {
+			return "", fmt.Errorf("document %s/%s/%s has no digest", doc.Index, doc.Type, doc.Id)
+		}
+		return digest, nil
+	}
+	return m.docHash(doc.Source), nil
+}
+
+// parseFieldPaths splits the comma separated fields of
+// --ignore_compare_fields into their dotted paths
+func parseFieldPaths(fields string) [][]string {
+	paths := [][]string{}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) > 0 {
+			paths = append(paths, strings.Split(field, "."))
+		}
+	}
+	return paths
+}
+
+// docHash hashes the source in a canonical form, without the ignored fields:
+// the keys are sorted and the numbers written the same way, so the same
+// document has the same hash on both sides. A source which can not be
+// parsed is hashed as it is
+func (m *Migrator) docHash(source json.RawMessage) string {
+	canonical := []byte(source)
+	if doc, err := m.canonicalDoc(source); err == nil {
+		if b, err := json.Marshal(doc); err == nil {
+			canonical = b
+		}
+	}
+	sum := sha1.Sum(canonical)
+	return string(sum[:])
+}
+
+// canonicalDoc parses the source, without the ignored fields and with the
+// numbers in their canonical form
+func (m *Migrator) canonicalDoc(source json.RawMessage) (interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(source))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for _, path := range m.compareIgnore {
+		removePath(doc, path)
+	}
+	return canonicalJson(doc), nil
+}
+
+// removePath deletes a field from the objects, also from the ones in arrays.
+// A field may be nested, or have dots in its name
+func removePath(doc interface{}, path []string) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for i := len(path); i > 0; i-- {
+			key := strings.Join(path[:i], ".")
+			child, ok := v[key]
+			if !ok {
+				continue
+			}
+			if i == len(path) {
+				delete(v, key)
+			} else {
+				removePath(child, path[i:])
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			removePath(item, path)
+		}
+	}
+}
+
+// canonicalJson writes the numbers in their shortest form, 1.0 and 1e0 are 1,
+// the keys of the objects are sorted by json.Marshal
+func canonicalJson(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = canonicalJson(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = canonicalJson(child)
+		}
+	case json.Number:
+		return canonicalNumber(v)
+	}
+	return doc
+}
+
+// canonicalNumber keeps integers as their digits, also the ones written with
+// a fraction or an exponent, without a float which would round the big ones.
+// The other numbers are written in their shortest float form
+func canonicalNumber(v json.Number) json.Number {
+	s := string(v)
+	if !strings.ContainsAny(s, ".eE") {
+		if s == "-0" {
+			return "0"
+		}
+		return v
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return v
+	}
+	if f == math.Trunc(f) {
+		//a float bounds the exponent, the digits stay few
+		if r, ok := new(big.Rat).SetString(s); ok && r.IsInt() {
+			return json.Number(r.Num().String())
+		}
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
@@ -0,0 +1,210 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalJson(t *testing.T) {
+	cases := []struct {
+		source string
+		want   string
+	}{
+		{`{"b":1,"a":2}`, `{"a":2,"b":1}`},
+		{`1.0`, `1`},
+		{`1e2`, `100`},
+		{`-0.0`, `0`},
+		{`1.50`, `1.5`},
+		{`1.5e-7`, `1.5e-07`},
+		{`-0`, `0`},
+		{`9007199254740993`, `9007199254740993`},
+		{`9007199254740991.0`, `9007199254740991`},
+		{`9007199254740993.0`, `9007199254740993`},
+		{`12345678901234567890`, `12345678901234567890`},
+		{`12345678901234567891.00`, `12345678901234567891`},
+		{`1.2345678901234567891e19`, `12345678901234567891`},
+		{`1e20`, `100000000000000000000`},
+		{`1.00000000000000000001e20`, `100000000000000000001`},
+		{`1.5e300`, `15` + strings.Repeat("0", 299)},
+		{`0.1e1`, `1`},
+		{`1.0000000000000000001`, `1`},
+		{`[1.0,{"y":2.50,"x":"1.0"}]`, `[1,{"x":"1.0","y":2.5}]`},
+		{`{"a":{"c":[1e0,true,null],"b":{}}}`, `{"a":{"b":{},"c":[1,true,null]}}`},
+	}
+	m := &Migrator{Config: &Config{}}
+	for _, c := range cases {
+		doc, err := m.canonicalDoc(json.RawMessage(c.source))
+		if err != nil {
+			t.Fatalf("%s: %v", c.source, err)
+		}
+		got, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatalf("%s: %v", c.source, err)
+		}
+		if string(got) != c.want {
+			t.Errorf("canonical json of %s is %s, want %s", c.source, got, c.want)
+		}
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		fields string
+		want   string
+	}{
+		{"top level", `{"a":1,"b":2}`, "a", `{"b":2}`},
+		{"nested", `{"a":{"b":1,"c":2}}`, "a.b", `{"a":{"c":2}}`},
+		{"missing", `{"a":{"c":2}}`, "a.b,x", `{"a":{"c":2}}`},
+		{"not an object", `{"a":1}`, "a.b", `{"a":1}`},
+		{"in arrays", `{"a":[{"b":1},{"b":2,"c":3},4]}`, "a.b", `{"a":[{},{"c":3},4]}`},
+		{"dots in the name", `{"a.b":1,"c":2}`, "a.b", `{"c":2}`},
+		{"dots and nested", `{"a.b":1,"a":{"b":2,"c":3}}`, "a.b", `{"a":{"c":3}}`},
+		{"dots in the middle", `{"a":{"b.c":{"d":1,"e":2}}}`, "a.b.c.d", `{"a":{"b.c":{"e":2}}}`},
+		{"several", `{"a":1,"b":{"c":2,"d":3},"e":4}`, " a , b.c ,", `{"b":{"d":3},"e":4}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var doc interface{}
+			if err := json.Unmarshal([]byte(c.source), &doc); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range parseFieldPaths(c.fields) {
+				removePath(doc, path)
+			}
+			got, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldPaths(t *testing.T) {
+	got := parseFieldPaths(" a, b.c ,,d.e.f")
+	want := [][]string{{"a"}, {"b", "c"}, {"d", "e", "f"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got = parseFieldPaths(""); len(got) != 0 {
+		t.Errorf("got %v for no fields", got)
+	}
+}
+
+func TestDocHash(t *testing.T) {
+	cases := []struct {
+		name   string
+		ignore string
+		a      string
+		b      string
+		same   bool
+	}{
+		{"key order", "", `{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, true},
+		{"number form", "", `{"a":1,"b":2.5}`, `{"a":1.0,"b":25e-1}`, true},
+		{"whitespace", "", `{"a": {"b": 1}}`, `{"a":{"b":1}}`, true},
+		{"value", "", `{"a":1}`, `{"a":2}`, false},
+		{"string and number", "", `{"a":1}`, `{"a":"1"}`, false},
+		{"array order", "", `{"a":[1,2]}`, `{"a":[2,1]}`, false},
+		{"big integers", "", `{"a":12345678901234567890}`, `{"a":12345678901234567891}`, false},
+		{"big integer forms", "", `{"a":12345678901234567890}`, `{"a":1.234567890123456789e19}`, true},
+		{"ignored field", "updated_at", `{"a":1,"updated_at":1}`, `{"a":1,"updated_at":2}`, true},
+		{"ignored nested field", "meta.ts", `{"a":1,"meta":{"ts":1,"v":1}}`, `{"meta":{"v":1,"ts":2},"a":1}`, true},
+		{"ignored field missing", "updated_at", `{"a":1,"updated_at":1}`, `{"a":1}`, true},
+		{"other fields", "updated_at", `{"a":1,"updated_at":1}`, `{"a":2,"updated_at":1}`, false},
+		{"invalid json", "", `{"a":`, `{"a":`, true},
+		{"invalid json differs", "", `{"a":`, `{"b":`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Migrator{Config: &Config{}, compareIgnore: parseFieldPaths(c.ignore)}
+			same := m.docHash(json.RawMessage(c.a)) == m.docHash(json.RawMessage(c.b))
+			if same != c.same {
+				t.Errorf("same hash of %s and %s is %v, want %v", c.a, c.b, same, c.same)
+			}
+		})
+	}
+}
+
+func TestDigestOption(t *testing.T) {
+	m := &Migrator{Config: &Config{Fields: "a,b.c"}, compareIgnore: parseFieldPaths("b.c.d")}
+	body := newScrollBody("", "", 0, 1, m.Config.Fields, []ScrollOption{m.digestOption()})
+	if body["_source"] != false {
+		t.Errorf("_source is %v, want false", body["_source"])
+	}
+	script := body["script_fields"].(map[string]interface{})[digestField].(map[string]interface{})["script"].(map[string]interface{})
+	params, err := json.Marshal(script["params"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"fields":[["a"],["b","c"]],"ignore":[["b","c","d"]]}`; string(params) != want {
+		t.Errorf("params are %s, want %s", params, want)
+	}
+
+	//the script loops over both, they are never null
+	m = &Migrator{Config: &Config{}}
+	body = newScrollBody("", "", 0, 1, "", []ScrollOption{m.digestOption()})
+	script = body["script_fields"].(map[string]interface{})[digestField].(map[string]interface{})["script"].(map[string]interface{})
+	if params, _ = json.Marshal(script["params"]); string(params) != `{"fields":[],"ignore":[]}` {
+		t.Errorf("params are %s without fields", params)
+	}
+}
+
+func TestCheckCompareScript(t *testing.T) {
+	cases := []struct {
+		source string
+		target string
+		fields string
+		ok     bool
+	}{
+		{"7.10.2", "8.5.0", "", true},
+		{"7.10.2", "7.10.2", "a,b.c", true},
+		{"6.8.0", "7.10.2", "", false},
+		{"7.10.2", "6.8.0", "", false},
+		{"7.10.2", "7.10.2", "a,b.*", false},
+	}
+	for _, c := range cases {
+		m := &Migrator{Config: &Config{Fields: c.fields}, SourceESAPI: versionAPI(c.source), TargetESAPI: versionAPI(c.target)}
+		if err := m.checkCompareScript(); (err == nil) != c.ok {
+			t.Errorf("%s to %s with fields [%s]: %v", c.source, c.target, c.fields, err)
+		}
+	}
+}
+
+func TestEntryHash(t *testing.T) {
+	m := &Migrator{Config: &Config{CompareMode: CompareScript}}
+	doc := &Document{Id: "1", Fields: map[string]interface{}{digestField: []interface{}{"abc"}}}
+	if hash, err := m.entryHash(doc); err != nil || hash != "abc" {
+		t.Errorf("hash is %q, %v, want the digest", hash, err)
+	}
+	if _, err := m.entryHash(&Document{Id: "2", Source: json.RawMessage(`{"a":1}`)}); err == nil {
+		t.Error("a document without digest should fail")
+	}
+
+	m.Config.CompareMode = CompareSource
+	source := json.RawMessage(`{"a":1}`)
+	if hash, err := m.entryHash(&Document{Id: "3", Source: source}); err != nil || hash != m.docHash(source) {
+		t.Errorf("hash is %q, %v, want the hash of the source", hash, err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"os"
+	"sync"
+)
+
+// DeadLetter is a document rejected by the target, written in the dump file
+// format with the rejection attached, the extra field is ignored when the
+// file is loaded again with -i
+type DeadLetter struct {
+	Document
+	Error DeadLetterError `json:"_error"`
+}
+
+type DeadLetterError struct {
+	Status int    `json:"status,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type DeadLetterWriter struct {
+	lock  sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	count int
+}
+
+func NewDeadLetterWriter(fileName string) (*DeadLetterWriter, error) {
+	var f *os.File
+	var err error
+	if checkFileIsExist(fileName) {
+		f, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, os.ModeAppend)
+	} else {
+		f, err = os.Create(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (d *DeadLetterWriter) Write(failures []BulkFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, failure := range failures {
+		//a deleted document has nothing to replay
+		if failure.Op == "delete" {
+			continue
+		}
+		letter := DeadLetter{Document: failure.Doc}
+		letter.Error.Status = failure.Status
+		letter.Error.Type = failure.Type
+		letter.Error.Reason = failure.Reason
+		jsr, err := json.Marshal(letter)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		d.w.Write(jsr)
+		d.w.WriteString("\n")
+		d.count++
+	}
+	if err := d.w.Flush(); err != nil {
+		log.Error(err)
+	}
+}
+
+func (d *DeadLetterWriter) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.w.Flush()
+	d.f.Close()
+	if d.count > 0 {
+		log.Warnf("%d rejected documents were written to %s", d.count, d.f.Name())
+	}
+}
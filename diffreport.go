@@ -0,0 +1,176 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DiffReportNdjson = "ndjson"
+	DiffReportCsv    = "csv"
+
+	changeAdded   = "added"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+// DiffChange is a line of the diff report: a document sync adds, updates or
+// deletes, or the totals of an index when Change is "total"
+type DiffChange struct {
+	Index   string   `json:"index"`
+	Target  string   `json:"target"`
+	Type    string   `json:"type,omitempty"`
+	Id      string   `json:"id,omitempty"`
+	Change  string   `json:"change"`
+	Fields  []string `json:"fields,omitempty"` //fields which differ, of an update
+	Added   *int     `json:"added,omitempty"`
+	Updated *int     `json:"updated,omitempty"`
+	Deleted *int     `json:"deleted,omitempty"`
+}
+
+var diffReportCsvHeader = []string{"index", "target", "type", "id", "change", "fields", "added", "updated", "deleted"}
+
+// DiffReport lists every change of a sync, with --dry it is what a sync
+// would change
+type DiffReport struct {
+	lock   sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	csv    *csv.Writer
+	Fields bool
+}
+
+func NewDiffReport(fileName string, format string, fields bool) (*DiffReport, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r := &DiffReport{f: f, w: bufio.NewWriter(f), Fields: fields}
+	if format == DiffReportCsv {
+		r.csv = csv.NewWriter(r.w)
+		r.csv.Write(diffReportCsvHeader)
+	}
+	return r, nil
+}
+
+func (r *DiffReport) Write(changes []DiffChange) {
+	if r == nil || len(changes) == 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range changes {
+		r.write(&changes[i])
+	}
+	if r.csv != nil {
+		r.csv.Flush()
+	}
+	if err := r.w.Flush(); err != nil {
+		log.Error(err)
+	}
+}
+
+func (r *DiffReport) write(change *DiffChange) {
+	if r.csv != nil {
+		count := func(n *int) string {
+			if n == nil {
+				return ""
+			}
+			return strconv.Itoa(*n)
+		}
+		r.csv.Write([]string{change.Index, change.Target, change.Type, change.Id, change.Change,
+			strings.Join(change.Fields, ";"), count(change.Added), count(change.Updated), count(change.Deleted)})
+		return
+	}
+	jsr, err := json.Marshal(change)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	r.w.Write(jsr)
+	r.w.WriteString("\n")
+}
+
+// Summary writes the totals of a synced index
+func (r *DiffReport) Summary(pair *syncPair) {
+	if r == nil {
+		return
+	}
+	added, updated, deleted := pair.added, pair.updated, pair.deleted
+	r.Write([]DiffChange{{Index: pair.source, Target: pair.target, Change: "total",
+		Added: &added, Updated: &updated, Deleted: &deleted}})
+}
+
+func (r *DiffReport) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.csv != nil {
+		r.csv.Flush()
+	}
+	r.w.Flush()
+	r.f.Close()
+	log.Infof("the changes of the sync were written to %s", r.f.Name())
+}
+
+// diffFields returns the dotted paths of the fields which differ between
+// two canonical documents, objects are compared field by field
+func diffFields(src interface{}, dst interface{}, prefix string) []string {
+	srcMap, srcOk := src.(map[string]interface{})
+	dstMap, dstOk := dst.(map[string]interface{})
+	if !srcOk || !dstOk {
+		if reflect.DeepEqual(src, dst) {
+			return nil
+		}
+		return []string{prefix}
+	}
+
+	keys := map[string]struct{}{}
+	for key := range srcMap {
+		keys[key] = struct{}{}
+	}
+	for key := range dstMap {
+		keys[key] = struct{}{}
+	}
+	fields := []string{}
+	for key := range keys {
+		path := key
+		if len(prefix) > 0 {
+			path = prefix + "." + key
+		}
+		srcValue, inSrc := srcMap[key]
+		dstValue, inDst := dstMap[key]
+		if !inSrc || !inDst {
+			fields = append(fields, path)
+			continue
+		}
+		fields = append(fields, diffFields(srcValue, dstValue, path)...)
+	}
+	sort.Strings(fields)
+	return fields
+}
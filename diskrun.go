@@ -0,0 +1,336 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// runMergeFanIn is the most runs merged at once, a bucket being joined holds
+// no more than twice that many files open, for its two sides
+const runMergeFanIn = 16
+
+// runEntry is what sync keeps of a document to compare it: its id, what is
+// needed to fetch it again, and the hash of its source
+type runEntry struct {
+	index   string
+	id      string
+	typ     string
+	routing string
+	hash    string
+}
+
+func (e *runEntry) less(o *runEntry) bool {
+	if e.id != o.id {
+		return e.id < o.id
+	}
+	return e.typ < o.typ
+}
+
+// runBuckets spreads the entries in the runs of their bucket, by the hash
+// of their id, so an id is in the same bucket on both sides
+type runBuckets struct {
+	writers []*runWriter
+}
+
+// newRunBuckets shares the limit of entries in memory between the buckets
+func newRunBuckets(dir string, prefix string, buckets int, limit int) *runBuckets {
+	b := &runBuckets{}
+	for i := 0; i < buckets; i++ {
+		b.writers = append(b.writers, newRunWriter(dir, fmt.Sprintf("%s-%d", prefix, i), limit/buckets))
+	}
+	return b
+}
+
+func (b *runBuckets) add(e runEntry) error {
+	h := fnv.New32a()
+	h.Write([]byte(e.id))
+	return b.writers[h.Sum32()%uint32(len(b.writers))].add(e)
+}
+
+func (b *runBuckets) remove() {
+	for _, w := range b.writers {
+		w.remove()
+	}
+}
+
+// runWriter keeps at most limit entries in memory, they are sorted by id and
+// spilled to a temp file when it is full
+type runWriter struct {
+	lock    sync.Mutex
+	dir     string
+	prefix  string
+	limit   int
+	entries []runEntry
+	files   []string
+}
+
+func newRunWriter(dir string, prefix string, limit int) *runWriter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &runWriter{dir: dir, prefix: prefix, limit: limit}
+}
+
+func (w *runWriter) add(e runEntry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.entries = append(w.entries, e)
+	if len(w.entries) >= w.limit {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *runWriter) flush() error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	sort.Slice(w.entries, func(i, j int) bool {
+		return w.entries[i].less(&w.entries[j])
+	})
+
+	f, err := os.CreateTemp(w.dir, w.prefix+"-*.run")
+	if err != nil {
+		return err
+	}
+	w.files = append(w.files, f.Name())
+	buf := bufio.NewWriter(f)
+	for i := range w.entries {
+		writeRunEntry(buf, &w.entries[i])
+	}
+	err = buf.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	w.entries = w.entries[:0]
+	return err
+}
+
+// merge spills what is left and returns the entries of all the runs in order.
+// Past runMergeFanIn runs, they are first merged into bigger ones, so no more
+// than runMergeFanIn files are open at once
+func (w *runWriter) merge() (*runMerger, error) {
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	for len(w.files) > runMergeFanIn {
+		if err := w.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return openRuns(w.files)
+}
+
+// compact merges the runs by groups of runMergeFanIn into one run each
+func (w *runWriter) compact() error {
+	files := []string{}
+	for i := 0; i < len(w.files); i += runMergeFanIn {
+		end := i + runMergeFanIn
+		if end > len(w.files) {
+			end = len(w.files)
+		}
+		group := w.files[i:end]
+		if len(group) == 1 {
+			files = append(files, group[0])
+			continue
+		}
+		name, err := w.mergeRuns(group)
+		if err != nil {
+			//the runs left are still removed with the writer
+			w.files = append(files, w.files[i:]...)
+			return err
+		}
+		files = append(files, name)
+		for _, name := range group {
+			os.Remove(name)
+		}
+	}
+	w.files = files
+	return nil
+}
+
+// mergeRuns writes the entries of the runs of files into a new run
+func (w *runWriter) mergeRuns(files []string) (string, error) {
+	merger, err := openRuns(files)
+	if err != nil {
+		return "", err
+	}
+	defer merger.close()
+
+	f, err := os.CreateTemp(w.dir, w.prefix+"-*.run")
+	if err != nil {
+		return "", err
+	}
+	buf := bufio.NewWriter(f)
+	for {
+		var e *runEntry
+		if e, err = merger.next(); err != nil || e == nil {
+			break
+		}
+		writeRunEntry(buf, e)
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// openRuns opens the runs of files, merged by their next entry
+func openRuns(files []string) (*runMerger, error) {
+	merger := &runMerger{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			merger.close()
+			return nil, err
+		}
+		reader := &runReader{file: f, buf: bufio.NewReader(f)}
+		if err = reader.next(); err != nil {
+			reader.file.Close()
+			merger.close()
+			return nil, err
+		}
+		if reader.head != nil {
+			merger.readers = append(merger.readers, reader)
+		} else {
+			reader.file.Close()
+		}
+	}
+	heap.Init(merger)
+	return merger, nil
+}
+
+// remove deletes the temp files of the runs
+func (w *runWriter) remove() {
+	for _, name := range w.files {
+		os.Remove(name)
+	}
+	w.files = nil
+}
+
+func writeRunEntry(buf *bufio.Writer, e *runEntry) {
+	for _, s := range []string{e.id, e.index, e.typ, e.routing, e.hash} {
+		writeRunString(buf, s)
+	}
+}
+
+func writeRunString(buf *bufio.Writer, s string) {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(s)))
+	buf.Write(size[:n])
+	buf.WriteString(s)
+}
+
+func readRunString(buf *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	if _, err = io.ReadFull(buf, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// runReader reads the entries of one run, head is the next one
+type runReader struct {
+	file *os.File
+	buf  *bufio.Reader
+	head *runEntry
+}
+
+func (r *runReader) next() error {
+	e := &runEntry{}
+	var err error
+	if e.id, err = readRunString(r.buf); err != nil {
+		r.head = nil
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	for _, s := range []*string{&e.index, &e.typ, &e.routing, &e.hash} {
+		if *s, err = readRunString(r.buf); err != nil {
+			r.head = nil
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	r.head = e
+	return nil
+}
+
+// runMerger is a heap of the run readers by their next entry
+type runMerger struct {
+	readers []*runReader
+}
+
+func (h *runMerger) Len() int           { return len(h.readers) }
+func (h *runMerger) Less(i, j int) bool { return h.readers[i].head.less(h.readers[j].head) }
+func (h *runMerger) Swap(i, j int)      { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runMerger) Push(x interface{}) { h.readers = append(h.readers, x.(*runReader)) }
+func (h *runMerger) Pop() interface{} {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
+
+// next returns the smallest entry left, nil once all the runs are read
+func (h *runMerger) next() (*runEntry, error) {
+	if len(h.readers) == 0 {
+		return nil, nil
+	}
+	reader := h.readers[0]
+	e := reader.head
+	if err := reader.next(); err != nil {
+		return nil, err
+	}
+	if reader.head == nil {
+		reader.file.Close()
+		heap.Pop(h)
+	} else {
+		heap.Fix(h, 0)
+	}
+	return e, nil
+}
+
+func (h *runMerger) close() {
+	for _, reader := range h.readers {
+		reader.file.Close()
+	}
+	h.readers = nil
+}
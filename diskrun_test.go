@@ -0,0 +1,306 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func entry(id string, typ string, hash string) runEntry {
+	return runEntry{index: "index", id: id, typ: typ, routing: "r-" + id, hash: hash}
+}
+
+// mergeAll reads all the entries of the runs of w, in merge order
+func mergeAll(t *testing.T, w *runWriter) []runEntry {
+	t.Helper()
+	merger, err := w.merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merger.close()
+	entries := []runEntry{}
+	for {
+		e, err := merger.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			return entries
+		}
+		entries = append(entries, *e)
+	}
+}
+
+func TestRunWriterMerge(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		add   []runEntry
+		want  []runEntry
+		runs  int
+	}{
+		{"empty", 10, nil, []runEntry{}, 0},
+		{"one run", 10,
+			[]runEntry{entry("c", "doc", "3"), entry("a", "doc", "1"), entry("b", "doc", "2")},
+			[]runEntry{entry("a", "doc", "1"), entry("b", "doc", "2"), entry("c", "doc", "3")}, 1},
+		{"spilled runs", 2,
+			[]runEntry{entry("e", "doc", "5"), entry("b", "doc", "2"), entry("d", "doc", "4"), entry("a", "doc", "1"), entry("c", "doc", "3")},
+			[]runEntry{entry("a", "doc", "1"), entry("b", "doc", "2"), entry("c", "doc", "3"), entry("d", "doc", "4"), entry("e", "doc", "5")}, 3},
+		{"same id in several runs", 1,
+			[]runEntry{entry("a", "t2", "2"), entry("b", "doc", "3"), entry("a", "t1", "1")},
+			[]runEntry{entry("a", "t1", "1"), entry("a", "t2", "2"), entry("b", "doc", "3")}, 3},
+		{"empty strings", 1,
+			[]runEntry{{id: "b"}, {id: "a", hash: "\x00\xff"}},
+			[]runEntry{{id: "a", hash: "\x00\xff"}, {id: "b"}}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := newRunWriter(dir, "test", c.limit)
+			for _, e := range c.add {
+				if err := w.add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := mergeAll(t, w)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("merged %v, want %v", got, c.want)
+			}
+			if len(w.files) != c.runs {
+				t.Errorf("spilled %d runs, want %d", len(w.files), c.runs)
+			}
+			w.remove()
+			if files, _ := filepath.Glob(filepath.Join(dir, "*.run")); len(files) > 0 {
+				t.Errorf("runs left after remove: %v", files)
+			}
+		})
+	}
+}
+
+func TestRunWriterMergeFanIn(t *testing.T) {
+	dir := t.TempDir()
+	w := newRunWriter(dir, "test", 1)
+	count := 2*runMergeFanIn + 5
+	for i := count - 1; i >= 0; i-- {
+		if err := w.add(entry(fmt.Sprintf("%03d", i), "doc", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merger, err := w.merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merger.readers) > runMergeFanIn {
+		t.Errorf("%d runs open at once, want at most %d", len(merger.readers), runMergeFanIn)
+	}
+	for i := 0; i < count; i++ {
+		e, err := merger.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || e.id != fmt.Sprintf("%03d", i) {
+			t.Fatalf("entry %d is %v", i, e)
+		}
+	}
+	if e, err := merger.next(); e != nil || err != nil {
+		t.Errorf("entry after the last one: %v, %v", e, err)
+	}
+	merger.close()
+
+	//the runs merged into bigger ones are removed
+	files, _ := filepath.Glob(filepath.Join(dir, "*.run"))
+	if len(files) != 3 || len(w.files) != 3 {
+		t.Errorf("%d runs on disk, %d kept, want 3", len(files), len(w.files))
+	}
+	w.remove()
+}
+
+func TestRunReaderTruncated(t *testing.T) {
+	w := newRunWriter(t.TempDir(), "test", 10)
+	if err := w.add(entry("a", "doc", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.remove()
+
+	//cut the run in the middle of the entry
+	info, err := os.Stat(w.files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(w.files[0], info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.merge(); err == nil {
+		t.Error("merge of a truncated run should fail")
+	}
+}
+
+func TestJoinRuns(t *testing.T) {
+	cases := []struct {
+		name          string
+		buckets       int
+		limit         int
+		ignoreContent bool
+		override      string
+		target        string //version of the target
+		src           []runEntry
+		dst           []runEntry
+		want          []string
+	}{
+		{name: "both empty", buckets: 1, limit: 10, want: []string{}},
+		{name: "empty buckets", buckets: 8, limit: 8,
+			src:  []runEntry{entry("a", "doc", "1")},
+			dst:  []runEntry{entry("a", "doc", "1")},
+			want: []string{}},
+		{name: "only in the source", buckets: 1, limit: 10,
+			src:  []runEntry{entry("a", "doc", "1"), entry("b", "doc", "2")},
+			want: []string{"added doc/a", "added doc/b"}},
+		{name: "only in the target", buckets: 1, limit: 10,
+			dst:  []runEntry{entry("a", "doc", "1"), entry("b", "doc", "2")},
+			want: []string{"deleted doc/a", "deleted doc/b"}},
+		{name: "source empty bucket, target not", buckets: 4, limit: 4,
+			src:  []runEntry{entry("a", "doc", "1")},
+			dst:  []runEntry{entry("a", "doc", "1"), entry("b", "doc", "2"), entry("c", "doc", "3")},
+			want: []string{"deleted doc/b", "deleted doc/c"}},
+		{name: "interleaved", buckets: 1, limit: 10,
+			src:  []runEntry{entry("a", "doc", "1"), entry("c", "doc", "3"), entry("d", "doc", "4"), entry("f", "doc", "6")},
+			dst:  []runEntry{entry("b", "doc", "2"), entry("c", "doc", "3"), entry("d", "doc", "x"), entry("e", "doc", "5")},
+			want: []string{"added doc/a", "added doc/f", "deleted doc/b", "deleted doc/e", "updated doc/d"}},
+		{name: "ids past the end of the other side", buckets: 1, limit: 10,
+			src:  []runEntry{entry("a", "doc", "1")},
+			dst:  []runEntry{entry("a", "doc", "1"), entry("z", "doc", "2")},
+			want: []string{"deleted doc/z"}},
+		{name: "ignore content", buckets: 1, limit: 10, ignoreContent: true,
+			src:  []runEntry{entry("a", "doc", "1"), entry("b", "doc", "2")},
+			dst:  []runEntry{entry("a", "doc", "x"), entry("c", "doc", "3")},
+			want: []string{"added doc/b", "deleted doc/c"}},
+		{name: "spilled runs", buckets: 2, limit: 2,
+			src:  []runEntry{entry("e", "doc", "5"), entry("a", "doc", "1"), entry("d", "doc", "4"), entry("b", "doc", "2"), entry("c", "doc", "3")},
+			dst:  []runEntry{entry("d", "doc", "x"), entry("c", "doc", "3"), entry("b", "doc", "2"), entry("f", "doc", "6")},
+			want: []string{"added doc/a", "added doc/e", "deleted doc/f", "updated doc/d"}},
+		{name: "duplicates across runs", buckets: 1, limit: 1,
+			src:  []runEntry{entry("a", "t2", "2"), entry("b", "doc", "3"), entry("a", "t1", "1")},
+			dst:  []runEntry{entry("a", "t1", "1"), entry("b", "doc", "3"), entry("a", "t2", "2")},
+			want: []string{}},
+		{name: "type only on one side", buckets: 1, limit: 1,
+			src:  []runEntry{entry("a", "t2", "2"), entry("a", "t1", "1")},
+			dst:  []runEntry{entry("a", "t1", "1")},
+			want: []string{"added t2/a"}},
+		{name: "types joined on the type, not in order", buckets: 1, limit: 10,
+			src:  []runEntry{entry("a", "t1", "1"), entry("a", "t2", "2")},
+			dst:  []runEntry{entry("a", "t2", "2"), entry("b", "t1", "3")},
+			want: []string{"added t1/a", "deleted t1/b"}},
+		{name: "types differ", buckets: 1, limit: 10,
+			src:  []runEntry{entry("a", "t1", "1")},
+			dst:  []runEntry{entry("a", "t2", "1")},
+			want: []string{"added t1/a", "deleted t2/a"}},
+		{name: "type overridden", buckets: 1, limit: 10, override: "t2",
+			src:  []runEntry{entry("a", "t1", "1"), entry("b", "t1", "2")},
+			dst:  []runEntry{entry("a", "t2", "1"), entry("b", "t2", "x")},
+			want: []string{"updated t1/b"}},
+		{name: "types written over each other", buckets: 1, limit: 10, override: "t",
+			src:  []runEntry{entry("a", "t1", "1"), entry("a", "t2", "2")},
+			dst:  []runEntry{entry("a", "t", "1")},
+			want: []string{}},
+		{name: "typeless target", buckets: 1, limit: 10, target: "7.10.2",
+			src:  []runEntry{entry("a", "doc", "1"), entry("b", "doc", "2"), entry("c", "doc", "3")},
+			dst:  []runEntry{entry("a", "_doc", "1"), entry("b", "_doc", "x"), entry("d", "_doc", "4")},
+			want: []string{"added doc/c", "deleted _doc/d", "updated doc/b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			reportFile := filepath.Join(dir, "report.json")
+			report, err := NewDiffReport(reportFile, DiffReportNdjson, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &Config{Dry: true, IgnoreContentCompare: c.ignoreContent, OverrideTypeName: c.override},
+				DiffReport: report}
+			changes := &syncChanges{m: m, pair: &syncPair{source: "src", target: "dst"}, batchSize: 2}
+			if len(c.target) > 0 {
+				m.TargetESAPI = versionAPI(c.target)
+				changes.dstMajor, _ = versionOf(m.TargetESAPI)
+			}
+
+			srcRuns := newRunBuckets(dir, "src", c.buckets, c.limit)
+			dstRuns := newRunBuckets(dir, "dst", c.buckets, c.limit)
+			defer srcRuns.remove()
+			defer dstRuns.remove()
+			for _, e := range c.src {
+				if err = srcRuns.add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, e := range c.dst {
+				if err = dstRuns.add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := range srcRuns.writers {
+				if err = m.joinRuns(srcRuns.writers[i], dstRuns.writers[i], changes); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report.Close()
+
+			got := readReport(t, reportFile)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("changes %v, want %v", got, c.want)
+			}
+			counts := map[string]int{}
+			for _, change := range c.want {
+				counts[strings.Fields(change)[0]]++
+			}
+			if changes.adds != counts[changeAdded] || changes.updates != counts[changeUpdated] || changes.deletes != counts[changeDeleted] {
+				t.Errorf("counted %d added, %d updated, %d deleted, want %v", changes.adds, changes.updates, changes.deletes, counts)
+			}
+		})
+	}
+}
+
+// readReport returns the changes of a ndjson diff report as "change type/id", sorted
+func readReport(t *testing.T, fileName string) []string {
+	t.Helper()
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	changes := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		change := DiffChange{}
+		if err = json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, change.Change+" "+change.Type+"/"+change.Id)
+	}
+	sort.Strings(changes)
+	return changes
+}
@@ -29,9 +29,20 @@ type Document struct {
 	Id      string          `json:"_id,omitempty"`
 	Source  json.RawMessage `json:"_source,omitempty"`
 	Routing string          `json:"routing,omitempty"` //after 6, only `routing` was supported
+	Sort    []interface{}   `json:"sort,omitempty"`
+
+	//metadata of the hits, asked with --copy_metadata
+	HitRouting string                 `json:"_routing,omitempty"`
+	Parent     string                 `json:"_parent,omitempty"`
+	Version    *int64                 `json:"_version,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"` //1.x/2.x return _routing and _parent here
+
+	checkpoint *scrollBatch
 }
 
 type Scroll struct {
+	slice *sliceState
+
 	Took     int    `json:"took,omitempty"`
 	ScrollId string `json:"_scroll_id,omitempty"`
 	TimedOut bool   `json:"timed_out,omitempty"`
@@ -76,8 +87,26 @@ type ClusterVersion struct {
 }
 
 type ClusterHealth struct {
-	Name   string `json:"cluster_name,omitempty"`
-	Status string `json:"status,omitempty"`
+	Name     string `json:"cluster_name,omitempty"`
+	Status   string `json:"status,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+}
+
+type NodesStats struct {
+	Nodes map[string]NodeStats `json:"nodes,omitempty"`
+}
+
+type NodeStats struct {
+	Name       string                     `json:"name,omitempty"`
+	ThreadPool map[string]ThreadPoolStats `json:"thread_pool,omitempty"`
+}
+
+type ThreadPoolStats struct {
+	Threads   int   `json:"threads,omitempty"`
+	Queue     int   `json:"queue,omitempty"`
+	Active    int   `json:"active,omitempty"`
+	Rejected  int64 `json:"rejected,omitempty"`
+	Completed int64 `json:"completed,omitempty"`
 }
 
 // {"took":23,"errors":true,"items":[{"create":{"_index":"mybank3","_type":"my_doc2","_id":"AWz8rlgUkzP-cujdA_Fv","status":409,"error":{"type":"version_conflict_engine_exception","reason":"[AWz8rlgUkzP-cujdA_Fv]: version conflict, document already exists (current version [1])","index_uuid":"w9JZbJkfSEWBI-uluWorgw","shard":"0","index":"mybank3"}}},{"create":{"_index":"mybank3","_type":"my_doc4","_id":"AWz8rpF2kzP-cujdA_Fx","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc4]"}}},{"create":{"_index":"mybank3","_type":"my_doc1","_id":"AWz8rjpJkzP-cujdA_Fu","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc1]"}}},{"create":{"_index":"mybank3","_type":"my_doc3","_id":"AWz8rnbckzP-cujdA_Fw","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc3]"}}},{"create":{"_index":"mybank3","_type":"my_doc5","_id":"AWz8rrsEkzP-cujdA_Fy","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, my_doc5]"}}},{"create":{"_index":"mybank3","_type":"doc","_id":"3","status":400,"error":{"type":"illegal_argument_exception","reason":"Rejecting mapping update to [mybank3] as the final mapping would have more than 1 type: [my_doc2, doc]"}}}]}
@@ -95,6 +124,21 @@ type Action struct {
 	Error  interface{} `json:"error,omitempty"`
 }
 
+// BulkResult is the outcome of a bulk request, once the rejected items were retried
+type BulkResult struct {
+	Succeeded int           //items accepted by the target
+	Retried   int           //items sent again after a retriable rejection
+	Failed    []BulkFailure //items the target did not accept
+}
+
+type BulkFailure struct {
+	Op     string
+	Doc    Document
+	Status int
+	Type   string
+	Reason string
+}
+
 type Migrator struct {
 	FlushLock   sync.Mutex
 	DocChan     chan Document
@@ -103,6 +147,40 @@ type Migrator struct {
 	SourceAuth  *Auth
 	TargetAuth  *Auth
 	Config      *Config
+	DeadLetter  *DeadLetterWriter
+	DiffReport  *DiffReport
+	Checkpoint  *CheckpointTracker
+
+	BulkController *BulkController
+
+	//index split from a type => source index
+	splitSources map[string]string
+
+	//source index => types tagged in the join field
+	joinTypes map[string]map[string]bool
+
+	//fields left out of the documents compared by sync
+	compareIgnore [][]string
+
+	//source index => documents read, when reading index by index
+	readProgress   map[string]*indexProgress
+	readFallback   *indexProgress
+	QueryDSL       map[string]interface{}
+	BulkThrottle   *Throttle
+	Pressure       *PressureMonitor
+	ScrollThrottle *Throttle
+
+	//closed when the migration is asked to stop
+	stop chan struct{}
+
+	//first error which left the migration incomplete
+	errLock sync.Mutex
+	err     error
+
+	//bulk outcome of the whole migration, updated atomically by the bulk workers
+	SucceededDocs int64
+	RetriedDocs   int64
+	FailedDocs    int64
 }
 
 type Config struct {
@@ -110,6 +188,7 @@ type Config struct {
 	// config options
 	SourceEs            string `short:"s" long:"source"  description:"source elasticsearch instance, ie: http://localhost:9200"`
 	Query               string `short:"q" long:"query"  description:"query against source elasticsearch instance, filter data before migrate, ie: name:medcl"`
+	QueryDSL            string `long:"query_dsl" description:"query dsl against source elasticsearch instance, inline json or @file.json, ie: {\"range\":{\"created\":{\"gte\":\"2020-01-01\"}}}"`
 	SortField           string `long:"sort" description:"sort field when scroll, ie: _id" default:"_id"`
 	TargetEs            string `short:"d" long:"dest"    description:"destination elasticsearch instance, ie: http://localhost:9201"`
 	SourceEsAuthStr     string `short:"m" long:"source_auth"  description:"basic auth of source elasticsearch instance, ie: user:pass"`
@@ -118,8 +197,16 @@ type Config struct {
 	BufferCount         int    `long:"buffer_count"   description:"number of buffered documents in memory" default:"1000000"`
 	Workers             int    `short:"w" long:"workers" description:"concurrency number for bulk workers" default:"1"`
 	BulkSizeInMB        int    `short:"b" long:"bulk_size" description:"bulk size in MB" default:"5"`
-	ScrollTime          string `short:"t" long:"time"    description:"scroll time" default:"10m"`
+	ScrollTime          string `short:"t" long:"time"    description:"scroll time, also the keep alive of the point in time" default:"10m"`
+	SplitTypes          string `long:"split_types" description:"split each type of 1.x-5.x indices into its own index, named after this template, ie: {index}-{type}"`
+	JoinField           string `long:"join_field" description:"merge the types of 1.x-5.x indices with _parent mappings into one type, with a join field of this name holding the parent/child relations"`
+	CopyMetadata        bool   `long:"copy_metadata" description:"read the version, routing and parent of the documents, write the version with version_type=external_gte and the parent on targets before 7.0"`
+	ShardFailure        string `long:"shard_failure" description:"what to do when shards fail to answer a scroll page: retry the slice from the previous page, abort, or ignore and only log them" default:"retry" choice:"retry" choice:"abort" choice:"ignore"`
+	Reader              string `long:"reader" description:"how to read the source: scroll, pit (point in time and search_after, es 7.12+), or auto to use pit when the source supports it" default:"auto" choice:"auto" choice:"scroll" choice:"pit"`
 	ScrollSliceSize     int    `long:"sliced_scroll_size"    description:"size of sliced scroll, to make it work, the size should be > 1" default:"1"`
+	PartitionField      string `long:"partition_field" description:"read each index in windows of this date or numeric field instead of sliced scroll, for sources before 5.0"`
+	Partitions          int    `long:"partitions" description:"number of windows of partition_field, the documents without the field are read by one more window" default:"4"`
+	ReadWorkers         int    `long:"read_workers" description:"number of slices read at the same time, each source index is read on its own, in sliced_scroll_size slices, 0 reads all the slices of an index at once" default:"0"`
 	RecreateIndex       bool   `short:"f" long:"force"   description:"delete destination index before copying"`
 	CopyAllIndexes      bool   `short:"a" long:"all"     description:"copy indexes starting with . and _"`
 	CopyIndexSettings   bool   `long:"copy_settings"          description:"copy index settings from source"`
@@ -138,23 +225,57 @@ type Config struct {
 	TargetProxy         string `long:"dest_proxy"            description:"set proxy to target http connections, ie: http://127.0.0.1:8080"`
 	Refresh             bool   `long:"refresh"                 description:"refresh after migration finished"`
 	Sync                bool   `long:"sync"                   description:"sync will use scroll for both source and target index, compare the data and sync(index/update/delete)"`
+	CompareMode         string `long:"compare_mode" description:"how sync compares the documents: source reads the sources and hashes them, script only reads a digest computed by the cluster, es 7.0+" default:"source" choice:"source" choice:"script"`
+	SyncRunSize         int    `long:"sync_run_size" description:"number of ids of each side kept in memory by sync, before they are sorted and written to a temp file" default:"100000"`
+	SyncTmpDir          string `long:"sync_tmp_dir" description:"directory of the temp files of sync, the system temp directory by default"`
+	DiffReportFile      string `long:"diff_report" description:"write every document sync adds, updates or deletes into this file, and the totals of each index, with --dry it is what sync would change"`
+	DiffReportFormat    string `long:"diff_report_format" description:"format of the diff report" default:"ndjson" choice:"ndjson" choice:"csv"`
+	DiffReportFields    bool   `long:"diff_report_fields" description:"add the fields which differ to the updates of the diff report, the documents are fetched from both sides"`
+	Follow              bool   `long:"follow" description:"copy the documents changed in the source indices, by follow_field, every follow_interval, until stopped"`
+	FollowField         string `long:"follow_field" description:"date field of the modification time of the documents, ie: updated_at"`
+	FollowInterval      int    `long:"follow_interval" description:"seconds between two rounds of follow" default:"10"`
+	FollowOverlap       int    `long:"follow_overlap" description:"seconds before the high-water mark read again by each round, for the documents not yet searchable in the previous one" default:"60"`
+	FollowStateFile     string `long:"follow_state_file" description:"file keeping the high-water mark of each index, a follow started again continues from it" default:"follow.json"`
+	SyncWorkers         int    `long:"sync_workers" description:"number of source indices synced at the same time, when -x matches more than one" default:"1"`
 	Fields              string `long:"fields"                 description:"filter source fields(white list), comma separated, ie: col1,col2,col3,..." `
 	SkipFields          string `long:"skip"                   description:"skip source fields(black list), comma separated, ie: col1,col2,col3,..." `
 	RenameFields        string `long:"rename"                 description:"rename source fields, comma separated, ie: _type:type, name:myname" `
 	LogstashEndpoint    string `short:"l"  long:"logstash_endpoint"    description:"target logstash tcp endpoint, ie: 127.0.0.1:5055" `
 	LogstashSecEndpoint bool   `long:"secured_logstash_endpoint"    description:"target logstash tcp endpoint was secured by TLS" `
 
-	RepeatOutputTimes              int    `long:"repeat_times"            description:"repeat the data from source N times to dest output, use align with parameter regenerate_id to amplify the data size "`
-	RegenerateID                   bool   `short:"r" long:"regenerate_id"   description:"regenerate id for documents, this will override the exist document id in data source"`
-	Compress                       bool   `long:"compress"            description:"use gzip to compress traffic"`
-	SleepSecondsAfterEachBulk      int    `short:"p" long:"sleep" description:"sleep N seconds after each bulk request" default:"-1"`
-	DiffCounts                     bool   `long:"diff_counts" description:"count the difference between source and target indexes"`
-	RemainMappingRoutingAllocation bool   `long:"remain_routing_allocation" description:"keep routing allocation in mappings"`
-	OnlyMeta                       bool   `long:"only_meta" description:"only sync meta"`
-	Dry                            bool   `long:"dry" description:"only dry"`
-	EnableDelete                   bool   `long:"enable_delete"          description:"enable delete records in dest index if there are more records"`
-	IgnoreContentCompare           bool   `long:"ignore_content_compare" description:"ignore to compare the content of a record"`
-	IgnoreFieldsInCompare          string `long:"ignore_compare_fields" description:"fields to ignore when compare documents, comma separated, ie: col1,col2,col3,..." `
+	RepeatOutputTimes              int     `long:"repeat_times"            description:"repeat the data from source N times to dest output, use align with parameter regenerate_id to amplify the data size "`
+	RegenerateID                   bool    `short:"r" long:"regenerate_id"   description:"regenerate id for documents, this will override the exist document id in data source"`
+	Compress                       bool    `long:"compress"            description:"use gzip to compress traffic"`
+	SleepSecondsAfterEachBulk      int     `short:"p" long:"sleep" description:"sleep N seconds after each bulk request" default:"-1"`
+	DiffCounts                     bool    `long:"diff_counts" description:"count the difference between source and target indexes"`
+	RemainMappingRoutingAllocation bool    `long:"remain_routing_allocation" description:"keep routing allocation in mappings"`
+	OnlyMeta                       bool    `long:"only_meta" description:"only sync meta"`
+	Dry                            bool    `long:"dry" description:"only dry"`
+	EnableDelete                   bool    `long:"enable_delete"          description:"enable delete records in dest index if there are more records"`
+	IgnoreContentCompare           bool    `long:"ignore_content_compare" description:"ignore to compare the content of a record"`
+	IgnoreFieldsInCompare          string  `long:"ignore_compare_fields" description:"fields to ignore when compare documents, comma separated, nested fields are dotted, ie: col1,col2.sub,col3,..." `
+	RetryMaxAttempts               int     `long:"retry_max_attempts" description:"max attempts of a request to elasticsearch, and of the documents rejected in a bulk request, 1 disables retries" default:"5"`
+	RetryDelay                     int     `long:"retry_delay" description:"delay in milliseconds before the first retry, doubled on each attempt" default:"500"`
+	RetryMaxDelay                  int     `long:"retry_max_delay" description:"max delay in milliseconds between two attempts" default:"30000"`
+	RetryJitter                    float64 `long:"retry_jitter" description:"fraction of the retry delay randomly added or removed" default:"0.2"`
+	MaxDocsPerSec                  int     `long:"max_docs_per_sec" description:"max documents per second sent to the target, shared by all the bulk workers"`
+	MaxBytesPerSec                 int     `long:"max_bytes_per_sec" description:"max bytes per second sent to the target, shared by all the bulk workers"`
+	ScrollMaxDocsPerSec            int     `long:"scroll_max_docs_per_sec" description:"max documents per second read from the source, shared by all the scroll slices"`
+	ScrollMaxBytesPerSec           int     `long:"scroll_max_bytes_per_sec" description:"max bytes of _source per second read from the source, shared by all the scroll slices"`
+	PressureMonitor                bool    `long:"pause_on_pressure" description:"poll the health and the write thread pool of the target during the migration, pause the bulk workers while it is red or rejecting writes"`
+	PressureCheckInterval          int     `long:"pressure_check_interval" description:"seconds between two checks of the target pressure" default:"5"`
+	PressureMaxRejections          int64   `long:"pressure_max_rejections" description:"pause when the write thread pool of the target rejected more than N requests since the last check" default:"0"`
+	PressureMaxWriteQueue          int     `long:"pressure_max_write_queue" description:"pause when a node of the target has more than N requests in its write queue, 0 to ignore the queue" default:"0"`
+	AdaptiveBulk                   bool    `long:"adaptive_bulk" description:"adjust the bulk size and the number of active bulk workers from the latency and the rejections of the target, within the min values and -b/-w"`
+	AdaptiveMinBulkSizeInMB        int     `long:"adaptive_min_bulk_size" description:"min bulk size in MB of the adaptive bulk" default:"1"`
+	AdaptiveMinWorkers             int     `long:"adaptive_min_workers" description:"min number of active bulk workers of the adaptive bulk" default:"1"`
+	AdaptiveTargetLatency          int     `long:"adaptive_target_latency" description:"bulk latency in milliseconds the adaptive bulk stays under" default:"2000"`
+	AsyncTranslog                  bool    `long:"async_translog" description:"set index.translog.durability to async on the target indices during the migration"`
+	RestoreWaitGreen               bool    `long:"restore_wait_green" description:"wait for the target indices to be green after their replicas were restored"`
+	CheckpointFile                 string  `long:"checkpoint_file" description:"record how far each source index and slice got into this file, so an interrupted migration can be resumed with --resume" `
+	CheckpointInterval             int     `long:"checkpoint_interval" description:"seconds between two writes of the checkpoint file" default:"10"`
+	Resume                         bool    `long:"resume" description:"resume the migration from --checkpoint_file, finished slices are skipped and the others continue from the last acknowledged sort value"`
+	DeadLetterFile                 string  `long:"dead_letter_file" description:"write documents rejected by the target into this file, in the same format as --output_file, they can be fixed and replayed with -i" `
 }
 
 type Auth struct {
@@ -0,0 +1,131 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TransportError is returned when a request got no response, ie: connection
+// refused or reset, timeout
+type TransportError struct {
+	Method string
+	Url    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s %s failed: %v", e.Method, e.Url, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatusError is returned when elasticsearch answered with an error
+// status, with the error type and reason taken from the response body
+type HTTPStatusError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Type       string
+	Reason     string
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if len(e.Type) > 0 {
+		return fmt.Sprintf("%s %s: server error: code=%d, type=%s, reason=%s", e.Method, e.Url, e.StatusCode, e.Type, e.Reason)
+	}
+	return fmt.Sprintf("%s %s: server error: code=%d, info=%s", e.Method, e.Url, e.StatusCode, SubString(e.Body, 0, 500))
+}
+
+func newHTTPStatusError(method string, url string, statusCode int, body []byte) *HTTPStatusError {
+	e := &HTTPStatusError{Method: method, Url: url, StatusCode: statusCode, Body: string(body)}
+
+	//{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}
+	response := struct {
+		Error interface{} `json:"error"`
+	}{}
+	if json.Unmarshal(body, &response) == nil {
+		switch v := response.Error.(type) {
+		case string:
+			//es 1.x answers the error as a plain string
+			e.Reason = v
+		case map[string]interface{}:
+			e.Type, _ = v["type"].(string)
+			e.Reason, _ = v["reason"].(string)
+		}
+	}
+	return e
+}
+
+// DecodeError is returned when a response body is not what we expected
+type DecodeError struct {
+	Body string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode response: %v, body: %s", e.Err, SubString(e.Body, 0, 500))
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ShardFailureError is returned when some shards failed to answer a search page
+type ShardFailureError struct {
+	Failures []string
+}
+
+func (e *ShardFailureError) Error() string {
+	return fmt.Sprintf("%d shards failed: %s", len(e.Failures), strings.Join(e.Failures, ", "))
+}
+
+// isSearchContextMissing tells whether err is about an expired or lost
+// scroll or point in time, 7.x wraps it into search_phase_execution_exception
+// and 1.x answers it as a plain string
+func isSearchContextMissing(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return strings.Contains(statusErr.Body, "search_context_missing_exception") ||
+			strings.Contains(statusErr.Body, "SearchContextMissingException")
+	}
+	var shardErr *ShardFailureError
+	if errors.As(err, &shardErr) {
+		for _, failure := range shardErr.Failures {
+			if strings.Contains(failure, "search_context_missing_exception") ||
+				strings.Contains(failure, "SearchContextMissingException") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrorType returns the elasticsearch error type carried by err, if any
+func ErrorType(err error) string {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Type
+	}
+	return ""
+}
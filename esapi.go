@@ -20,8 +20,10 @@ import "bytes"
 
 type ESAPI interface {
 	ClusterHealth() *ClusterHealth
+	WaitForIndexHealth(indexNames string, status string, timeout string) (*ClusterHealth, error)
+	NodesThreadPoolStats() (*NodesStats, error)
 	ClusterVersion() *ClusterVersion
-	Bulk(data *bytes.Buffer) error
+	Bulk(data *bytes.Buffer) (*BulkResult, error)
 	GetIndexSettings(indexNames string) (*Indexes, error)
 	DeleteIndex(name string) error
 	CreateIndex(name string, settings map[string]interface{}) error
@@ -29,9 +31,12 @@ type ESAPI interface {
 	UpdateIndexSettings(indexName string, settings map[string]interface{}) error
 	UpdateIndexMapping(indexName string, mappings map[string]interface{}) error
 	NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-		slicedId int, maxSlicedCount int, fields string) (ScrollAPI, error)
+		slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (ScrollAPI, error)
 	NextScroll(scrollTime string, scrollId string) (ScrollAPI, error)
 	DeleteScroll(scrollId string) error
+	ValidateQuery(indexNames string, query map[string]interface{}) error
+	FieldRange(indexNames string, field string) (min *float64, max *float64, date bool, err error)
+	MultiGet(indexName string, docs []Document, fields string) ([]Document, error)
 	Refresh(name string) (err error)
 	GetIndices(pattern string) (*map[string]IndexInfo, error)
 }
@@ -0,0 +1,48 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "errors"
+
+// process exit codes, see the README for the meaning of each
+const (
+	ExitOK          = 0
+	ExitError       = 1 //invalid options, local files or any other error
+	ExitTransport   = 2 //elasticsearch could not be reached
+	ExitHTTPStatus  = 3 //elasticsearch answered with an error
+	ExitDecode      = 4 //elasticsearch answered something unexpected
+	ExitDocsFailed  = 5 //finished, but some documents were rejected by the target
+	ExitInterrupted = 130
+)
+
+func exitCode(err error) int {
+	var transportErr *TransportError
+	var statusErr *HTTPStatusError
+	var decodeErr *DecodeError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &transportErr):
+		return ExitTransport
+	case errors.As(err, &statusErr):
+		return ExitHTTPStatus
+	case errors.As(err, &decodeErr):
+		return ExitDecode
+	default:
+		return ExitError
+	}
+}
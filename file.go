@@ -46,7 +46,7 @@ func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 	defer f.Close()
 	r := bufio.NewReader(f)
 	lineCount := 0
-	for {
+	for !m.Stopping() {
 		line, err := r.ReadString('\n')
 		if io.EOF == err || nil != err {
 			break
@@ -133,6 +133,8 @@ func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 				}
 			}
 		*/
+		//sort values only matter to the scroll
+		docI.Sort = nil
 		jsr, err := json.Marshal(docI)
 		log.Trace(string(jsr))
 		if err != nil {
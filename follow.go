@@ -0,0 +1,179 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"math"
+	"os"
+	"time"
+)
+
+// FollowState is the content of the follow state file: the high-water mark
+// of the follow field of each source index, in epoch millis for dates
+type FollowState struct {
+	Field   string             `json:"field"`
+	Indices map[string]float64 `json:"indices"`
+}
+
+// loadFollowState reads the marks of the previous run from fileName, there
+// are none the first time
+func loadFollowState(fileName string, field string) (*FollowState, error) {
+	state := &FollowState{Field: field, Indices: map[string]float64{}}
+	if !checkFileIsExist(fileName) {
+		return state, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("can not read the follow state %s: %w", fileName, err)
+	}
+	if state.Field != field {
+		return nil, fmt.Errorf("the follow state %s is of field %s, not %s", fileName, state.Field, field)
+	}
+	if state.Indices == nil {
+		state.Indices = map[string]float64{}
+	}
+	return state, nil
+}
+
+func (s *FollowState) save(fileName string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpFile := fileName + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
+
+// follow copies the documents changed in the source indices to their
+// targets every --follow_interval, until stopped. Each round reads the
+// documents whose follow field is above the mark of the previous round,
+// minus --follow_overlap for the documents not yet searchable back then.
+// The first round, without a mark, copies all the documents
+func (m *Migrator) follow(pairs []*syncPair) error {
+	cfg := m.Config
+	state, err := loadFollowState(cfg.FollowStateFile, cfg.FollowField)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(cfg.FollowInterval) * time.Second
+	log.Infof("follow %d indices on %s, every %s", len(pairs), cfg.FollowField, interval)
+
+	for {
+		for _, pair := range pairs {
+			if m.Stopping() {
+				return nil
+			}
+			mark := state.Indices[pair.source]
+			copied, err := m.followIndex(pair, state)
+			if err != nil {
+				//the mark did not move, the next round reads the same documents again
+				if !isRetriableError(err) && !m.recoverable(err) {
+					return err
+				}
+				log.Warnf("failed to follow %s, retry in %s: %v", pair.source, interval, err)
+				continue
+			}
+			if copied > 0 && state.Indices[pair.source] == mark {
+				log.Debugf("follow %s to %s, copied the %d documents of the overlap again", pair.source, pair.target, copied)
+			} else if copied > 0 {
+				log.Infof("follow %s to %s, copied %d documents, up to %s=%v", pair.source, pair.target,
+					copied, cfg.FollowField, followMark(state.Indices[pair.source]))
+			}
+		}
+
+		select {
+		case <-m.stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// followIndex copies the documents of the source index changed since its
+// mark, the mark is moved and saved once they were all written
+func (m *Migrator) followIndex(pair *syncPair, state *FollowState) (int, error) {
+	cfg := m.Config
+	field := cfg.FollowField
+	_, max, date, err := m.SourceESAPI.FieldRange(pair.source, field)
+	if err != nil {
+		return 0, err
+	}
+	if max == nil {
+		return 0, nil
+	}
+	mark, marked := state.Indices[pair.source]
+	window, upper := followWindow(mark, marked, *max, float64(cfg.FollowOverlap)*1000)
+	clause := m.rangeClause(field, window, date)
+
+	copied := 0
+	_, err = m.scrollPages(m.SourceESAPI, pair.source, 0, 0, nil, func(docs []Document) error {
+		if len(docs) == 0 {
+			return nil
+		}
+		writes := make([]Document, 0, len(docs))
+		for i := range docs {
+			doc := &docs[i]
+			writes = append(writes, Document{Id: doc.Id, Type: m.targetType(doc.Type), Routing: doc.routing(), Source: doc.Source})
+		}
+		copied += len(writes)
+		return m.bulkRecords(opIndex, m.TargetESAPI, pair.target, writes)
+	}, WithFilter(clause))
+	if err != nil || m.Stopping() {
+		return copied, err
+	}
+
+	if marked && upper == mark {
+		return copied, nil
+	}
+	state.Indices[pair.source] = upper
+	if err = state.save(cfg.FollowStateFile); err != nil {
+		return copied, fmt.Errorf("can not save the follow state %s: %w", cfg.FollowStateFile, err)
+	}
+	return copied, nil
+}
+
+// followWindow returns the range of the follow field a round reads, and the
+// mark it moves to. The overlap before the mark is read again by every round,
+// even without newer documents: one of them may have become searchable since
+// the previous round
+func followWindow(mark float64, marked bool, max float64, overlap float64) (map[string]interface{}, float64) {
+	if marked && max < mark {
+		max = mark
+	}
+	window := map[string]interface{}{"lte": followMark(max)}
+	if marked {
+		window["gte"] = followMark(mark - overlap)
+	}
+	return window, max
+}
+
+// followMark keeps whole marks whole, dates are in epoch millis
+func followMark(value float64) interface{} {
+	if value == math.Trunc(value) {
+		return int64(value)
+	}
+	return value
+}
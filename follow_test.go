@@ -0,0 +1,72 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFollowWindow(t *testing.T) {
+	cases := []struct {
+		name    string
+		mark    float64
+		marked  bool
+		max     float64
+		overlap float64
+		window  map[string]interface{}
+		newMark float64
+	}{
+		{name: "first round", max: 5000, overlap: 1000,
+			window: map[string]interface{}{"lte": int64(5000)}, newMark: 5000},
+		{name: "newer documents", mark: 5000, marked: true, max: 9000, overlap: 1000,
+			window: map[string]interface{}{"gte": int64(4000), "lte": int64(9000)}, newMark: 9000},
+		{name: "no newer documents", mark: 5000, marked: true, max: 5000, overlap: 1000,
+			window: map[string]interface{}{"gte": int64(4000), "lte": int64(5000)}, newMark: 5000},
+		{name: "newest documents deleted", mark: 5000, marked: true, max: 3000, overlap: 1000,
+			window: map[string]interface{}{"gte": int64(4000), "lte": int64(5000)}, newMark: 5000},
+		{name: "fractional numbers", mark: 2.5, marked: true, max: 3.25, overlap: 1,
+			window: map[string]interface{}{"gte": 1.5, "lte": 3.25}, newMark: 3.25},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			window, mark := followWindow(c.mark, c.marked, c.max, c.overlap)
+			if !reflect.DeepEqual(window, c.window) || mark != c.newMark {
+				t.Errorf("window %v, mark %v, want %v, %v", window, mark, c.window, c.newMark)
+			}
+		})
+	}
+}
+
+func TestFollowState(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "follow.json")
+	state, err := loadFollowState(fileName, "updated_at")
+	if err != nil || len(state.Indices) != 0 {
+		t.Fatalf("new state %+v, %v", state, err)
+	}
+	state.Indices["logs"] = 1700000000000
+	if err = state.save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = loadFollowState(fileName, "updated_at"); err != nil || state.Indices["logs"] != 1700000000000 {
+		t.Errorf("loaded state %+v, %v", state, err)
+	}
+	if _, err = loadFollowState(fileName, "created_at"); err == nil {
+		t.Error("a state of another field should fail")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/parnurzeal/gorequest"
@@ -39,6 +38,28 @@ func BasicAuth(req *fasthttp.Request, user, pass string) {
 }
 
 func Get(url string, auth *Auth, proxy string) (*http.Response, string, []error) {
+	var resp *http.Response
+	var body string
+	var errs []error
+	retryPolicy.Retry("GET", url, func() error {
+		resp, body, errs = get(url, auth, proxy)
+		return gorequestError("GET", url, resp, body, errs)
+	})
+	return resp, body, errs
+}
+
+// gorequestError tells the retry policy whether a gorequest call failed
+func gorequestError(method string, url string, resp *http.Response, body string, errs []error) error {
+	if errs != nil {
+		return &TransportError{Method: method, Url: url, Err: errs[0]}
+	}
+	if resp != nil && isRetriableStatus(resp.StatusCode) {
+		return newHTTPStatusError(method, url, resp.StatusCode, []byte(body))
+	}
+	return nil
+}
+
+func get(url string, auth *Auth, proxy string) (*http.Response, string, []error) {
 
 	request := gorequest.New()
 
@@ -65,6 +86,17 @@ func Get(url string, auth *Auth, proxy string) (*http.Response, string, []error)
 }
 
 func Post(url string, auth *Auth, body string, proxy string) (*http.Response, string, []error) {
+	var resp *http.Response
+	var respBody string
+	var errs []error
+	retryPolicy.Retry("POST", url, func() error {
+		resp, respBody, errs = post(url, auth, body, proxy)
+		return gorequestError("POST", url, resp, respBody, errs)
+	})
+	return resp, respBody, errs
+}
+
+func post(url string, auth *Auth, body string, proxy string) (*http.Response, string, []error) {
 	request := gorequest.New()
 	tr := &http.Transport{
 		DisableKeepAlives:  true,
@@ -130,11 +162,21 @@ var fastHttpClient = &fasthttp.Client{
 }
 
 func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []byte, proxy string) (string, error) {
+	var respBody string
+	err := retryPolicy.Retry(method, loadUrl, func() error {
+		var err error
+		respBody, err = doRequest(compress, method, loadUrl, auth, body, proxy)
+		return err
+	})
+	return respBody, err
+}
+
+func doRequest(compress bool, method string, loadUrl string, auth *Auth, body []byte, proxy string) (string, error) {
 
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
-	//defer fasthttp.ReleaseRequest(req)   // <- do not forget to release
-	//defer fasthttp.ReleaseResponse(resp) // <- do not forget to release
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
 
 	req.SetRequestURI(loadUrl)
 	req.Header.SetMethod(method)
@@ -155,7 +197,7 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 		if compress {
 			_, err := fasthttp.WriteGzipLevel(req.BodyWriter(), body, fasthttp.CompressBestSpeed)
 			if err != nil {
-				panic(err)
+				return "", err
 			}
 		} else {
 			req.SetBody(body)
@@ -165,10 +207,7 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 	err := fastHttpClient.Do(req, resp)
 
 	if err != nil {
-		panic(err)
-	}
-	if resp == nil {
-		panic("empty response")
+		return "", &TransportError{Method: method, Url: loadUrl, Err: err}
 	}
 
 	log.Debug("received status code", resp.StatusCode, "from", string(resp.Header.Header()), "content",
@@ -178,6 +217,7 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 
 	} else {
 		//log.Error("received status code", resp.StatusCode, "from", string(resp.Header.Header()), "content", string(resp.Body()), req)
+		return "", newHTTPStatusError(method, loadUrl, resp.StatusCode(), resp.Body())
 	}
 
 	//if compress{
@@ -189,6 +229,38 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 }
 
 func Request(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, proxy string) (string, error) {
+	return requestIf(isRetriableError, compress, method, loadUrl, auth, body, proxy)
+}
+
+// RequestNoReplay sends a request which may not be sent twice: a scroll page,
+// the server moved on once it answered even if the answer was lost, or a bulk
+// with generated ids. It is only sent again when the server refused it
+func RequestNoReplay(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, proxy string) (string, error) {
+	return requestIf(isRejectedError, compress, method, loadUrl, auth, body, proxy)
+}
+
+func requestIf(retriable func(err error) bool, compress bool, method string, loadUrl string, auth *Auth,
+	body *bytes.Buffer, proxy string) (string, error) {
+
+	//keep the body, it is consumed by each attempt
+	var payload []byte
+	if body != nil {
+		payload = body.Bytes()
+	}
+	var respBody string
+	err := retryPolicy.RetryIf(method, loadUrl, retriable, func() error {
+		var reqBody *bytes.Buffer
+		if body != nil {
+			reqBody = bytes.NewBuffer(payload)
+		}
+		var err error
+		respBody, err = request(compress, method, loadUrl, auth, reqBody, proxy)
+		return err
+	})
+	return respBody, err
+}
+
+func request(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, proxy string) (string, error) {
 
 	var err error
 	var reqest *http.Request
@@ -199,7 +271,7 @@ func Request(compress bool, method string, loadUrl string, auth *Auth, body *byt
 	}
 
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	if auth != nil {
@@ -208,9 +280,11 @@ func Request(compress bool, method string, loadUrl string, auth *Auth, body *byt
 
 	oldTransport := client.Transport.(*http.Transport)
 	if len(proxy) > 0 {
-		proxyUrl := VerifyWithResult(url.Parse(proxy))
-		proxyFunc := http.ProxyURL(proxyUrl)
-		oldTransport.Proxy = proxyFunc
+		proxyUrl, err := url.Parse(proxy)
+		if err != nil {
+			return "", err
+		}
+		oldTransport.Proxy = http.ProxyURL(proxyUrl)
 	} else {
 		oldTransport.Proxy = nil
 	}
@@ -224,34 +298,21 @@ func Request(compress bool, method string, loadUrl string, auth *Auth, body *byt
 	resp, errs := client.Do(reqest)
 	if errs != nil {
 		log.Error(SubString(errs.Error(), 0, 500))
-		return "", errs
-	}
-
-	if resp != nil && resp.Body != nil {
-		//io.Copy(ioutil.Discard, resp.Body)
-		defer resp.Body.Close()
+		return "", &TransportError{Method: method, Url: loadUrl, Err: errs}
 	}
 
-	if resp.StatusCode != 200 {
-		b := VerifyWithResult(io.ReadAll(resp.Body))
-		return "", errors.New(
-			fmt.Sprintf("server error: code=%d, length=%d, info=", resp.StatusCode, resp.ContentLength) + string(b))
-	}
+	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
-
-	//log.Error(SubString(string(respBody), 0, 500))
-
 	if err != nil {
 		log.Error(SubString(string(err.Error()), 0, 500))
-		return string(respBody), err
+		return string(respBody), &TransportError{Method: method, Url: loadUrl, Err: err}
 	}
 
-	if err != nil {
-		return string(respBody), err
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", newHTTPStatusError(method, loadUrl, resp.StatusCode, respBody)
 	}
-	io.Copy(io.Discard, resp.Body)
-	defer resp.Body.Close()
+
 	return string(respBody), nil
 }
 
@@ -263,8 +324,7 @@ func DecodeJson(jsonStream string, o interface{}) error {
 	//decoder.
 
 	if err := decoder.Decode(o); err != nil {
-		fmt.Println("error:", err)
-		return err
+		return &DecodeError{Body: jsonStream, Err: err}
 	}
 	return nil
 }
@@ -275,8 +335,7 @@ func DecodeJsonBytes(jsonStream []byte, o interface{}) error {
 	decoder.UseNumber()
 
 	if err := decoder.Decode(o); err != nil {
-		fmt.Println("error:", err)
-		return err
+		return &DecodeError{Body: string(jsonStream), Err: err}
 	}
 	return nil
 }
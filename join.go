@@ -0,0 +1,129 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"sort"
+)
+
+// convertToJoin rewrites the mappings of each source index with _parent
+// types into one type, with a join field holding the parent/child relations
+// instead. The types in a relation are kept by index to tag the documents
+func (m *Migrator) convertToJoin(indexes *Indexes) error {
+	major, _ := versionOf(m.TargetESAPI)
+	m.joinTypes = map[string]map[string]bool{}
+
+	for name, index := range *indexes {
+		mappings, ok := index.(map[string]interface{})["mappings"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		types := []string{}
+		for typeName := range mappings {
+			types = append(types, typeName)
+		}
+		sort.Strings(types)
+
+		relations := map[string][]string{}
+		joinTypes := map[string]bool{}
+		merged := map[string]interface{}{}
+		properties := map[string]interface{}{}
+		for _, typeName := range types {
+			mapping, ok := mappings[typeName].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if parent, ok := mapping["_parent"].(map[string]interface{}); ok {
+				parentType, _ := parent["type"].(string)
+				relations[parentType] = append(relations[parentType], typeName)
+				joinTypes[parentType] = true
+				joinTypes[typeName] = true
+			}
+			for key, value := range mapping {
+				//the routing of the children is required by the _parent, not by the join
+				if key == "_parent" || key == "_routing" || key == "properties" {
+					continue
+				}
+				if _, ok := merged[key]; !ok {
+					merged[key] = value
+				}
+			}
+			typeProperties, _ := mapping["properties"].(map[string]interface{})
+			for field, property := range typeProperties {
+				if _, ok := properties[field]; ok {
+					log.Warnf("field %s of %s/%s is already mapped by another type, keep the first mapping", field, name, typeName)
+					continue
+				}
+				properties[field] = property
+			}
+		}
+		if len(relations) == 0 {
+			log.Warnf("index %s has no _parent mapping, nothing to join", name)
+			continue
+		}
+		if _, ok := properties[m.Config.JoinField]; ok {
+			return fmt.Errorf("index %s already has a field %s, choose another --join_field", name, m.Config.JoinField)
+		}
+
+		properties[m.Config.JoinField] = map[string]interface{}{"type": "join", "relations": relations}
+		merged["properties"] = properties
+		log.Infof("index %s, types %v are merged into %s with join field %s, relations: %v",
+			name, types, m.singleTypeName(), m.Config.JoinField, relations)
+
+		//7.0 mappings have no type
+		if major >= 7 {
+			index.(map[string]interface{})["mappings"] = merged
+		} else {
+			index.(map[string]interface{})["mappings"] = map[string]interface{}{m.singleTypeName(): merged}
+		}
+		m.joinTypes[name] = joinTypes
+	}
+	return nil
+}
+
+// joinDocument tags a parent or a child with its relation in the join field,
+// a child is routed to its parent. It returns the source and routing to write
+func (m *Migrator) joinDocument(src *Document, routing string) (json.RawMessage, string, error) {
+	if !m.joinTypes[src.Index][src.Type] {
+		return src.Source, routing, nil
+	}
+
+	join := map[string]interface{}{"name": src.Type}
+	if parent := src.parent(); len(parent) > 0 {
+		join["parent"] = parent
+		//the routing of a grand child is already the one of its root
+		if len(routing) == 0 {
+			routing = parent
+		}
+	}
+
+	source := map[string]json.RawMessage{}
+	if err := json.Unmarshal(src.Source, &source); err != nil {
+		return nil, routing, err
+	}
+	value, err := json.Marshal(join)
+	if err != nil {
+		return nil, routing, err
+	}
+	source[m.Config.JoinField] = value
+	data, err := json.Marshal(source)
+	return data, routing, err
+}
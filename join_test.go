@@ -0,0 +1,120 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func joinIndexes(t *testing.T) *Indexes {
+	t.Helper()
+	indexes := Indexes{}
+	err := json.Unmarshal([]byte(`{"blog": {"mappings": {
+		"post": {"properties": {"title": {"type": "text"}}},
+		"comment": {"_parent": {"type": "post"}, "_routing": {"required": true}, "properties": {"text": {"type": "text"}}},
+		"vote": {"_parent": {"type": "comment"}, "properties": {"text": {"type": "keyword"}}}
+	}}, "plain": {"mappings": {"doc": {"properties": {"a": {"type": "long"}}}}}}`), &indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &indexes
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestConvertToJoin(t *testing.T) {
+	relations := map[string]interface{}{"post": []string{"comment"}, "comment": []string{"vote"}}
+	properties := map[string]interface{}{
+		"title":    map[string]interface{}{"type": "text"},
+		"text":     map[string]interface{}{"type": "text"},
+		"relation": map[string]interface{}{"type": "join", "relations": relations},
+	}
+	cases := []struct {
+		target string
+		want   map[string]interface{}
+	}{
+		{"6.8.0", map[string]interface{}{"_doc": map[string]interface{}{"properties": properties}}},
+		{"7.17.0", map[string]interface{}{"properties": properties}},
+	}
+	for _, c := range cases {
+		indexes := joinIndexes(t)
+		m := &Migrator{Config: &Config{JoinField: "relation"}, TargetESAPI: versionAPI(c.target)}
+		if err := m.convertToJoin(indexes); err != nil {
+			t.Fatal(err)
+		}
+		got := (*indexes)["blog"].(map[string]interface{})["mappings"]
+		//the relations are []string, the rest comes from json
+		if data, _ := json.Marshal(got); string(data) != string(mustMarshal(t, c.want)) {
+			t.Errorf("%s: got %s, want %s", c.target, data, mustMarshal(t, c.want))
+		}
+		want := map[string]map[string]bool{"blog": {"post": true, "comment": true, "vote": true}}
+		if !reflect.DeepEqual(m.joinTypes, want) {
+			t.Errorf("%s: join types %v, want %v", c.target, m.joinTypes, want)
+		}
+		if _, ok := (*indexes)["plain"].(map[string]interface{})["mappings"].(map[string]interface{})["doc"]; !ok {
+			t.Errorf("%s: index without _parent was changed: %v", c.target, (*indexes)["plain"])
+		}
+	}
+}
+
+func TestConvertToJoinFieldTaken(t *testing.T) {
+	m := &Migrator{Config: &Config{JoinField: "text"}, TargetESAPI: versionAPI("6.8.0")}
+	if err := m.convertToJoin(joinIndexes(t)); err == nil {
+		t.Error("the join field replaced a field of the source")
+	}
+}
+
+func TestJoinDocument(t *testing.T) {
+	cases := []struct {
+		name        string
+		doc         Document
+		routing     string
+		wantSource  string
+		wantRouting string
+	}{
+		{"parent", Document{Index: "blog", Type: "post", Source: json.RawMessage(`{"title":"a"}`)}, "",
+			`{"relation":{"name":"post"},"title":"a"}`, ""},
+		{"child", Document{Index: "blog", Type: "comment", Parent: "1", Source: json.RawMessage(`{"text":"b"}`)}, "",
+			`{"relation":{"name":"comment","parent":"1"},"text":"b"}`, "1"},
+		{"grand child", Document{Index: "blog", Type: "vote", Parent: "2", Source: json.RawMessage(`{"text":"c"}`)}, "1",
+			`{"relation":{"name":"vote","parent":"2"},"text":"c"}`, "1"},
+		{"parent of 1.x", Document{Index: "blog", Type: "comment", Fields: map[string]interface{}{"_parent": "1"},
+			Source: json.RawMessage(`{}`)}, "", `{"relation":{"name":"comment","parent":"1"}}`, "1"},
+		{"type outside the relations", Document{Index: "blog", Type: "other", Source: json.RawMessage(`{"d":1}`)}, "r",
+			`{"d":1}`, "r"},
+	}
+	m := &Migrator{Config: &Config{JoinField: "relation"},
+		joinTypes: map[string]map[string]bool{"blog": {"post": true, "comment": true, "vote": true}}}
+	for _, c := range cases {
+		source, routing, err := m.joinDocument(&c.doc, c.routing)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(source) != c.wantSource || routing != c.wantRouting {
+			t.Errorf("%s: got %s routed to %q, want %s routed to %q", c.name, source, routing, c.wantSource, c.wantRouting)
+		}
+	}
+}
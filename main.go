@@ -14,10 +14,15 @@ import (
 	_ "runtime/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	go func() {
@@ -44,24 +49,41 @@ func main() {
 	// parse args
 	_, err = goflags.Parse(c)
 	if err != nil {
+		if flagsErr, ok := err.(*goflags.Error); ok && flagsErr.Type == goflags.ErrHelp {
+			return ExitOK
+		}
 		log.Error(err)
-		return
+		return exitCode(err)
 	}
 
 	setInitLogging(c.LogLevel)
+	defer log.Flush()
+
+	if c.RetryMaxAttempts < 1 {
+		c.RetryMaxAttempts = 1
+	}
+	retryPolicy = RetryPolicy{
+		MaxAttempts: c.RetryMaxAttempts,
+		BaseDelay:   time.Duration(c.RetryDelay) * time.Millisecond,
+		MaxDelay:    time.Duration(c.RetryMaxDelay) * time.Millisecond,
+		Jitter:      c.RetryJitter,
+	}
+	migrator.handleSignals()
+	migrator.BulkThrottle = NewThrottle(c.MaxDocsPerSec, c.MaxBytesPerSec)
+	migrator.ScrollThrottle = NewThrottle(c.ScrollMaxDocsPerSec, c.ScrollMaxBytesPerSec)
 
 	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 {
 		log.Error("no input, type --help for more details")
-		return
+		return ExitError
 	}
 	if len(c.TargetEs) == 0 && len(c.DumpOutFile) == 0 {
 		log.Error("no output, type --help for more details")
-		return
+		return ExitError
 	}
 
 	if c.SourceEs == c.TargetEs && c.SourceIndexNames == c.TargetIndexName {
 		log.Error("migration output is the same as the output")
-		return
+		return ExitError
 	}
 
 	var showBar bool = false
@@ -73,42 +95,136 @@ func main() {
 		showBar = false
 	}
 
-	if c.Sync {
-		//sync 功能时,只支持一个 index:
+	if len(c.DeadLetterFile) > 0 && len(c.TargetEs) > 0 {
+		migrator.DeadLetter, err = NewDeadLetterWriter(c.DeadLetterFile)
+		if err != nil {
+			log.Error(err)
+			return exitCode(err)
+		}
+		defer migrator.DeadLetter.Close()
+	}
+
+	if len(c.QueryDSL) > 0 {
+		migrator.QueryDSL, err = parseQueryDSL(c.QueryDSL)
+		if err != nil {
+			log.Error(err)
+			return ExitError
+		}
+	}
+
+	if c.Sync || c.Follow {
 		if len(c.SourceIndexNames) == 0 {
-			log.Error("migration sync only support source 1 index to 1 target index")
-			return
+			log.Error("sync and follow need the source indices, -x")
+			return ExitError
+		}
+		if c.Follow && len(c.FollowField) == 0 {
+			log.Error("follow needs the field of the modification time, --follow_field")
+			return ExitError
+		}
+		if c.Follow && (c.Sync || c.Dry) {
+			log.Error("follow can not be used with sync or dry")
+			return ExitError
+		}
+		migrator.SourceESAPI, err = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
+		if err != nil {
+			log.Error("can not parse source es api, ", err)
+			return exitCode(err)
+		}
+		migrator.TargetESAPI, err = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
+		if err != nil {
+			log.Error("can not parse target es api, ", err)
+			return exitCode(err)
+		}
+		if err = migrator.validateQueryDSL(migrator.SourceESAPI, c.SourceIndexNames); err != nil {
+			log.Error(err)
+			return exitCode(err)
+		}
+		migrator.compareIgnore = parseFieldPaths(c.IgnoreFieldsInCompare)
+		if c.Sync && c.CompareMode == CompareScript {
+			if err = migrator.checkCompareScript(); err != nil {
+				log.Error(err)
+				return ExitError
+			}
+		}
+		if len(c.DiffReportFile) > 0 {
+			migrator.DiffReport, err = NewDiffReport(c.DiffReportFile, c.DiffReportFormat, c.DiffReportFields)
+			if err != nil {
+				log.Error(err)
+				return ExitError
+			}
+			defer migrator.DiffReport.Close()
+		}
+		pairs, err := migrator.planSync()
+		if err != nil {
+			log.Error(err)
+			return ExitError
+		}
+		if c.Follow {
+			//follow runs until stopped
+			if err = migrator.follow(pairs); err != nil {
+				log.Error(err)
+				return exitCode(err)
+			}
+			if atomic.LoadInt64(&migrator.FailedDocs) > 0 {
+				return ExitDocsFailed
+			}
+			return ExitOK
 		}
-		if len(c.TargetIndexName) == 0 {
-			c.TargetIndexName = c.SourceIndexNames
+		err = migrator.syncIndices(pairs, c.SyncWorkers)
+		if err != nil {
+			log.Error(err)
+			return exitCode(err)
 		}
-		migrator.SourceESAPI = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
-		if migrator.SourceESAPI == nil {
-			log.Error("can not parse source es api")
-			return
+		if migrator.Stopping() {
+			return ExitInterrupted
 		}
-		migrator.TargetESAPI = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
-		if migrator.TargetESAPI == nil {
-			log.Error("can not parse target es api")
-			return
+		if atomic.LoadInt64(&migrator.FailedDocs) > 0 {
+			return ExitDocsFailed
 		}
-		migrator.SyncBetweenIndex(migrator.SourceESAPI, migrator.TargetESAPI, c)
-		return
+		return ExitOK
 	}
 
 	if c.DiffCounts {
-		migrator.SourceESAPI = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
-		if migrator.SourceESAPI == nil {
-			log.Error("can not parse source es api")
-			return
+		migrator.SourceESAPI, err = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
+		if err != nil {
+			log.Error("can not parse source es api, ", err)
+			return exitCode(err)
 		}
-		migrator.TargetESAPI = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
-		if migrator.TargetESAPI == nil {
-			log.Error("can not parse target es api")
-			return
+		migrator.TargetESAPI, err = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
+		if err != nil {
+			log.Error("can not parse target es api, ", err)
+			return exitCode(err)
 		}
 		migrator.DiffCounts(migrator.SourceESAPI, migrator.TargetESAPI)
-		return
+		return ExitOK
+	}
+
+	if len(c.CheckpointFile) > 0 && (len(c.SourceEs) == 0 || len(c.TargetEs) == 0 || c.RepeatOutputTimes > 1) {
+		log.Error("checkpoint only works when migrating from source to target es, without repeat_times")
+		return ExitError
+	}
+	if len(c.SplitTypes) > 0 && (len(c.TargetIndexName) > 0 || len(c.JoinField) > 0) {
+		log.Error("split_types names the target indices, it can't be used with -y or join_field")
+		return ExitError
+	}
+	if len(c.PartitionField) > 0 && c.ScrollSliceSize > 1 {
+		log.Warn("sliced_scroll_size is ignored, the indices are read in windows of partition_field")
+	}
+	if len(c.CheckpointFile) > 0 && len(c.PartitionField) > 0 {
+		log.Error("checkpoint can't be used with partition_field, the windows move with the data")
+		return ExitError
+	}
+	if c.Resume && len(c.CheckpointFile) == 0 {
+		log.Error("resume requires --checkpoint_file")
+		return ExitError
+	}
+	//resume reads again from the last sort value by a range query
+	if len(c.CheckpointFile) > 0 && (len(c.SortField) == 0 || c.SortField == "_id") {
+		log.Errorf("checkpoint needs a --sort field which supports range queries, ie: a numeric or date field, not [%s]", c.SortField)
+		return ExitError
+	}
+	if c.Resume && c.RegenerateID {
+		log.Warn("resume reads the documents of the last sort value again, with regenerate_id they are written twice")
 	}
 
 	//至少输出一次
@@ -120,7 +236,7 @@ func main() {
 
 	if c.RepeatOutputTimes > 0 {
 
-		for i := 0; i < c.RepeatOutputTimes; i++ {
+		for i := 0; i < c.RepeatOutputTimes && !migrator.Stopping(); i++ {
 
 			if c.RepeatOutputTimes > 1 {
 				log.Info("repeat round: ", i+1)
@@ -141,70 +257,65 @@ func main() {
 			if len(c.SourceEs) > 0 {
 				//dealing with basic auth
 
-				migrator.SourceESAPI = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr,
+				migrator.SourceESAPI, err = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr,
 					migrator.Config.SourceProxy, c.Compress)
-				if migrator.SourceESAPI == nil {
-					log.Error("can not parse source es api")
-					return
+				if err != nil {
+					log.Error("can not parse source es api, ", err)
+					return exitCode(err)
+				}
+				if err = migrator.validateQueryDSL(migrator.SourceESAPI, c.SourceIndexNames); err != nil {
+					log.Error(err)
+					return exitCode(err)
+				}
+				if major, _ := versionOf(migrator.SourceESAPI); len(c.JoinField) > 0 && major >= 6 {
+					log.Error("join_field converts the _parent mappings of 1.x-5.x sources, the source is ",
+						migrator.SourceESAPI.ClusterVersion().Version.Number)
+					return ExitError
 				}
 
 				if c.ScrollSliceSize < 1 {
 					c.ScrollSliceSize = 1
 				}
+
+				//the scan of 1.x/2.x has no sort values a checkpoint could resume from
+				if _, scan := migrator.SourceESAPI.(*ESAPIV0); scan && len(c.CheckpointFile) > 0 {
+					log.Error("checkpoint and resume need sort values, the scan of the source has none, it is ",
+						migrator.SourceESAPI.ClusterVersion().Version.Number)
+					return ExitError
+				}
+				if len(c.CheckpointFile) > 0 && migrator.Checkpoint == nil {
+					migrator.Checkpoint, err = NewCheckpointTracker(c.CheckpointFile, c.SortField, c.ScrollSliceSize, c.Resume)
+					if err != nil {
+						log.Error(err)
+						return exitCode(err)
+					}
+					migrator.Checkpoint.Start(time.Duration(c.CheckpointInterval) * time.Second)
+					defer migrator.Checkpoint.Stop()
+				}
 				// do read data
 				if c.OnlyMeta {
 					c.ScrollSliceSize = 0
 				}
 
-				totalSize := 0
-				finishedSlice := 0
-				for slice := 0; slice < c.ScrollSliceSize; slice++ {
-					scroll, err := migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.Query,
-						c.SortField, slice, c.ScrollSliceSize, c.Fields)
+				usePit, err := migrator.usePointInTime()
+				if err != nil {
+					log.Error(err)
+					return ExitError
+				}
+				if usePit {
+					log.Info("read the source with point in time and search_after")
+				}
+
+				if !c.OnlyMeta {
+					tasks, progress, err := migrator.planReadTasks(c.ScrollSliceSize)
 					if err != nil {
 						log.Error(err)
-						return
+						return exitCode(err)
 					}
-
-					totalSize += scroll.GetHitsTotal()
-
-					if scroll.GetDocs() != nil {
-
-						if scroll.GetHitsTotal() == 0 {
-							log.Warn("can't find documents from source.")
-							//return
-						}
-
-						go func() {
-							wg.Add(1)
-							//process input
-							// start scroll
-							scroll.ProcessScrollResult(&migrator, fetchBar)
-
-							// loop scrolling until done
-							for scroll.Next(&migrator, fetchBar) == false {
-							}
-
-							if showBar {
-								fetchBar.Finish()
-							}
-
-							// finished, close doc chan and wait for goroutines to be done
-							wg.Done()
-							finishedSlice++
-
-							//clean up final results
-							if finishedSlice == c.ScrollSliceSize {
-								log.Debug("closing doc chan")
-								close(migrator.DocChan)
-							}
-						}()
+					if len(tasks) == 0 {
+						log.Warnf("can't find index %s from source.", c.SourceIndexNames)
 					}
-				}
-
-				if totalSize > 0 {
-					fetchBar.Total = int64(totalSize)
-					outputBar.Total = int64(totalSize)
+					migrator.startReaders(tasks, progress, c.ReadWorkers, usePit, fetchBar, outputBar, &wg)
 				}
 
 			} else if len(c.DumpInputFile) > 0 {
@@ -213,7 +324,7 @@ func main() {
 				f, err := os.Open(c.DumpInputFile)
 				if err != nil {
 					log.Error(err)
-					return
+					return exitCode(err)
 				}
 				//get file lines
 				lineCount := 0
@@ -243,7 +354,8 @@ func main() {
 				// start pool
 				pool, err = pb.StartPool(fetchBar, outputBar)
 				if err != nil {
-					panic(err)
+					log.Error(err)
+					return ExitError
 				}
 			}
 
@@ -256,11 +368,11 @@ func main() {
 				}
 
 				//get target es api
-				migrator.TargetESAPI = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr,
+				migrator.TargetESAPI, err = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr,
 					migrator.Config.TargetProxy, false)
-				if migrator.TargetESAPI == nil {
-					log.Error("can not parse target es api")
-					return
+				if err != nil {
+					log.Error("can not parse target es api, ", err)
+					return exitCode(err)
 				}
 
 				log.Debug("start process with mappings")
@@ -277,6 +389,9 @@ func main() {
 				defer timer.Stop()
 				for {
 					timer.Reset(idleDuration)
+					if migrator.Stopping() {
+						return ExitInterrupted
+					}
 
 					if len(c.SourceEs) > 0 {
 						if status, ready := migrator.ClusterReady(migrator.SourceESAPI); !ready {
@@ -302,10 +417,24 @@ func main() {
 
 					if err != nil {
 						log.Error(err)
-						return
+						return exitCode(err)
+					}
+					if len(c.JoinField) > 0 {
+						if err = migrator.convertToJoin(sourceIndexMappings); err != nil {
+							log.Error(err)
+							return exitCode(err)
+						}
+					}
+					if len(c.SplitTypes) > 0 {
+						if err = migrator.splitTypes(sourceIndexMappings); err != nil {
+							log.Error(err)
+							return ExitError
+						}
 					}
 
-					sourceIndexRefreshSettings := map[string]interface{}{}
+					//index => settings overridden during the migration, with their original values
+					overriddenIndexSettings := map[string]map[string]interface{}{}
+					defer migrator.recoveryIndexSettings(overriddenIndexSettings)
 
 					log.Debugf("indexCount: %d", indexCount)
 
@@ -321,7 +450,7 @@ func main() {
 							log.Debug("source index settings:", sourceIndexSettings)
 							if err != nil {
 								log.Error(err)
-								return
+								return exitCode(err)
 							}
 
 							//get target index settings
@@ -339,6 +468,9 @@ func main() {
 								delete(*sourceIndexSettings, c.SourceIndexNames)
 								log.Debug(sourceIndexSettings)
 							}
+							if len(c.SplitTypes) > 0 {
+								migrator.splitIndexSettings(sourceIndexSettings)
+							}
 
 							// dealing with indices settings
 							for name, idx := range *sourceIndexSettings {
@@ -376,13 +508,10 @@ func main() {
 									tempIndexSettings["settings"].(map[string]interface{})["index"] = map[string]interface{}{}
 								}
 
-								sourceIndexRefreshSettings[name] = ((*sourceIndexSettings)[name].(map[string]interface{}))["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"]
-
-								//set refresh_interval
+								//set refresh_interval, replicas and translog durability for the migration
 								mapSettings := tempIndexSettings["settings"].(map[string]interface{})
 								mapIndex := mapSettings["index"].(map[string]interface{})
-								mapIndex["refresh_interval"] = -1
-								mapIndex["number_of_replicas"] = 0
+								overriddenIndexSettings[name] = overrideIndexSettings(mapIndex, c.AsyncTranslog)
 								//remove routing allocation
 								if _, ok := mapIndex["routing"]; ok && !c.RemainMappingRoutingAllocation {
 									delete(mapIndex, "routing")
@@ -412,7 +541,7 @@ func main() {
 									err := migrator.TargetESAPI.CreateIndex(name, tempIndexSettings)
 									if err != nil {
 										log.Error(err)
-										return
+										return exitCode(err)
 									}
 
 								}
@@ -432,7 +561,8 @@ func main() {
 								for name, mapping := range *sourceIndexMappings {
 									err := migrator.TargetESAPI.UpdateIndexMapping(name, mapping.(map[string]interface{})["mappings"].(map[string]interface{}))
 									if err != nil {
-										log.Error(err)
+										log.Errorf("failed to update mapping of index %s: %v", name, err)
+										return exitCode(err)
 									}
 								}
 							}
@@ -442,10 +572,9 @@ func main() {
 
 					} else {
 						log.Error("index not exists,", c.SourceIndexNames)
-						return
+						return ExitError
 					}
 
-					defer migrator.recoveryIndexSettings(sourceIndexRefreshSettings)
 				} else if len(c.DumpInputFile) > 0 {
 					//check shard settings
 					//TODO support shard config
@@ -462,6 +591,14 @@ func main() {
 				log.Debug("start es bulk workers")
 				outputBar.Prefix("Bulk")
 				var docCount int
+				if c.AdaptiveBulk && migrator.BulkController == nil {
+					migrator.BulkController = NewBulkController(c)
+				}
+				if c.PressureMonitor && migrator.Pressure == nil {
+					migrator.Pressure = NewPressureMonitor(migrator.TargetESAPI, c)
+					migrator.Pressure.Start()
+					defer migrator.Pressure.Stop()
+				}
 				wg.Add(c.Workers)
 				for i := 0; i < c.Workers; i++ {
 					go migrator.NewBulkWorker(&docCount, outputBar, &wg)
@@ -476,6 +613,9 @@ func main() {
 			wg.Wait()
 		FIN:
 			if showBar {
+				if len(c.SourceEs) > 0 {
+					fetchBar.Finish()
+				}
 
 				outputBar.Finish()
 				// close pool
@@ -486,5 +626,20 @@ func main() {
 
 	}
 
+	if len(c.TargetEs) > 0 && !c.OnlyMeta {
+		migrator.logBulkSummary()
+	}
+	if migrator.Stopping() {
+		log.Warn("data migration interrupted.")
+		return ExitInterrupted
+	}
+	if err := migrator.Err(); err != nil {
+		log.Errorf("data migration incomplete: %v", err)
+		return exitCode(err)
+	}
 	log.Info("data migration finished.")
+	if atomic.LoadInt64(&migrator.FailedDocs) > 0 {
+		return ExitDocsFailed
+	}
+	return ExitOK
 }
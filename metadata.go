@@ -0,0 +1,110 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// metadataOption asks the source for the metadata of the documents
+func (m *Migrator) metadataOption() ScrollOption {
+	if major, _ := versionOf(m.SourceESAPI); major < 5 {
+		//1.x/2.x only return _routing and _parent when asked, with the source
+		return WithMetadata("_source", "_routing", "_parent")
+	}
+	return WithMetadata()
+}
+
+// routing returns the routing of a hit, or the one of a dumped document
+func (d *Document) routing() string {
+	if len(d.Routing) > 0 {
+		return d.Routing
+	}
+	if len(d.HitRouting) > 0 {
+		return d.HitRouting
+	}
+	return d.field("_routing")
+}
+
+func (d *Document) parent() string {
+	if len(d.Parent) > 0 {
+		return d.Parent
+	}
+	return d.field("_parent")
+}
+
+func (d *Document) field(name string) string {
+	switch v := d.Fields[name].(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// metadataKeys are the keys of the metadata in the action line of a bulk
+// request, they lost their underscore in 6.x and _parent is gone in 7.0
+type metadataKeys struct {
+	routing     string
+	parent      string
+	version     string
+	versionType string
+}
+
+func bulkMetadataKeys(api ESAPI) metadataKeys {
+	major, _ := versionOf(api)
+	switch {
+	case major < 6:
+		return metadataKeys{routing: "_routing", parent: "_parent", version: "_version", versionType: "_version_type"}
+	case major == 6:
+		return metadataKeys{routing: "routing", parent: "parent", version: "version", versionType: "version_type"}
+	default:
+		return metadataKeys{routing: "routing", version: "version", versionType: "version_type"}
+	}
+}
+
+// bulkAction returns the action line of doc, with the metadata of src when
+// --copy_metadata is set. The version is written as external_gte, so the
+// target keeps the versions of the source and rejects older copies of a
+// document, while a copy written again, by a resume or a second run, is fine
+func (m *Migrator) bulkAction(op string, doc Document, src *Document, keys metadataKeys) interface{} {
+	if !m.Config.CopyMetadata {
+		return map[string]Document{op: doc}
+	}
+
+	meta := map[string]interface{}{"_index": doc.Index}
+	if len(doc.Type) > 0 {
+		meta["_type"] = doc.Type
+	}
+	if len(doc.Id) > 0 {
+		meta["_id"] = doc.Id
+	}
+	if len(doc.Routing) > 0 {
+		meta[keys.routing] = doc.Routing
+	}
+	//the join field replaces the parent
+	if parent := src.parent(); len(parent) > 0 && len(keys.parent) > 0 && len(m.Config.JoinField) == 0 {
+		meta[keys.parent] = parent
+	}
+	//a regenerated id has no version yet
+	if src.Version != nil && len(doc.Id) > 0 {
+		meta[keys.version] = *src.Version
+		meta[keys.versionType] = "external_gte"
+	}
+	return map[string]interface{}{op: meta}
+}
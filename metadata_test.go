@@ -0,0 +1,71 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetadataOption(t *testing.T) {
+	cases := []struct {
+		version string
+		fields  interface{}
+	}{
+		{"1.7.6", []string{"_source", "_routing", "_parent"}},
+		{"5.6.16", nil},
+		{"7.17.0", nil},
+	}
+	for _, c := range cases {
+		m := &Migrator{SourceESAPI: versionAPI(c.version)}
+		body := newScrollBody("", "", 0, 1, "", []ScrollOption{m.metadataOption()})
+		if body["version"] != true {
+			t.Errorf("%s: version not asked: %v", c.version, body)
+		}
+		if _, ok := body["seq_no_primary_term"]; ok {
+			t.Errorf("%s: seq_no_primary_term asked: %v", c.version, body)
+		}
+		if fields, ok := body["fields"]; ok != (c.fields != nil) || ok && !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("%s: got fields %v, want %v", c.version, fields, c.fields)
+		}
+	}
+}
+
+func TestBulkAction(t *testing.T) {
+	version := int64(3)
+	src := &Document{Index: "src", Id: "1", Version: &version, HitRouting: "r", Fields: map[string]interface{}{"_parent": []interface{}{"p"}}}
+	doc := Document{Index: "dst", Type: "doc", Id: "1", Routing: "r"}
+	cases := []struct {
+		name   string
+		copy   bool
+		target string
+		want   interface{}
+	}{
+		{"without copy_metadata", false, "5.6.16", map[string]Document{"index": doc}},
+		{"5.x target", true, "5.6.16", map[string]interface{}{"index": map[string]interface{}{
+			"_index": "dst", "_type": "doc", "_id": "1", "_routing": "r", "_parent": "p", "_version": version, "_version_type": "external_gte"}}},
+		{"7.x target", true, "7.17.0", map[string]interface{}{"index": map[string]interface{}{
+			"_index": "dst", "_type": "doc", "_id": "1", "routing": "r", "version": version, "version_type": "external_gte"}}},
+	}
+	for _, c := range cases {
+		m := &Migrator{Config: &Config{CopyMetadata: c.copy}}
+		got := m.bulkAction("index", doc, src, bulkMetadataKeys(versionAPI(c.target)))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
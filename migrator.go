@@ -26,8 +26,10 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -49,20 +51,106 @@ func (op BulkOperation) String() string {
 	}
 }
 
-func (m *Migrator) recoveryIndexSettings(sourceIndexRefreshSettings map[string]interface{}) {
-	//update replica and refresh_interval
-	for name, interval := range sourceIndexRefreshSettings {
+// settings changed on the target indices during the migration, with the
+// values they get back if the index had none before
+var migrationIndexSettings = []struct {
+	key          string
+	value        interface{}
+	defaultValue interface{}
+}{
+	{"refresh_interval", -1, "1s"},
+	{"number_of_replicas", 0, 1},
+	{"translog.durability", "async", "request"},
+}
+
+// overrideIndexSettings changes the index settings for the migration and
+// returns the original value of each changed setting
+func overrideIndexSettings(mapIndex map[string]interface{}, asyncTranslog bool) map[string]interface{} {
+	original := map[string]interface{}{}
+	for _, setting := range migrationIndexSettings {
+		if setting.key == "translog.durability" && !asyncTranslog {
+			continue
+		}
+		original[setting.key] = getIndexSetting(mapIndex, setting.key)
+		setIndexSetting(mapIndex, setting.key, setting.value)
+	}
+	return original
+}
+
+// getIndexSetting reads a dotted setting key, either nested or flat
+func getIndexSetting(mapIndex map[string]interface{}, key string) interface{} {
+	if v, ok := mapIndex[key]; ok {
+		return v
+	}
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 2 {
+		if nested, ok := mapIndex[parts[0]].(map[string]interface{}); ok {
+			return getIndexSetting(nested, parts[1])
+		}
+	}
+	return nil
+}
+
+func setIndexSetting(mapIndex map[string]interface{}, key string, value interface{}) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 2 {
+		if nested, ok := mapIndex[parts[0]].(map[string]interface{}); ok {
+			setIndexSetting(nested, parts[1], value)
+			return
+		}
+	}
+	mapIndex[key] = value
+}
+
+func (m *Migrator) recoveryIndexSettings(overriddenIndexSettings map[string]map[string]interface{}) {
+	//update replica, refresh_interval and translog durability
+	names := []string{}
+	for name, original := range overriddenIndexSettings {
 		tempIndexSettings := getEmptyIndexSettings()
-		tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"] = interval
-		//tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_replicas"] = 1
-		m.TargetESAPI.UpdateIndexSettings(name, tempIndexSettings)
+		mapIndex := tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})
+		for _, setting := range migrationIndexSettings {
+			value, ok := original[setting.key]
+			if !ok {
+				continue
+			}
+			if value == nil {
+				value = setting.defaultValue
+			}
+			mapIndex[setting.key] = value
+		}
+		log.Infof("restore settings of index %s: %v", name, mapIndex)
+		if err := m.TargetESAPI.UpdateIndexSettings(name, tempIndexSettings); err != nil {
+			log.Errorf("failed to restore settings of index %s: %v", name, err)
+		}
 		if m.Config.Refresh {
 			m.TargetESAPI.Refresh(name)
 		}
+		names = append(names, name)
+	}
+
+	if m.Config.RestoreWaitGreen && len(names) > 0 && !m.Stopping() {
+		m.waitForGreen(strings.Join(names, ","))
+	}
+}
+
+// waitForGreen waits until the replicas of the indices are allocated
+func (m *Migrator) waitForGreen(indexNames string) {
+	log.Infof("waiting for index %s to be green", indexNames)
+	for !m.Stopping() {
+		health, err := m.TargetESAPI.WaitForIndexHealth(indexNames, "green", "30s")
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if health.Status == "green" {
+			log.Infof("index %s is green", indexNames)
+			return
+		}
+		log.Infof("index %s is %s, still waiting for green", indexNames, health.Status)
 	}
 }
 
-func (m *Migrator) ClusterVersion(host string, auth *Auth, proxy string) (*ClusterVersion, []error) {
+func (m *Migrator) ClusterVersion(host string, auth *Auth, proxy string) (*ClusterVersion, error) {
 
 	url := fmt.Sprintf("%s", host)
 	resp, body, errs := Get(url, auth, proxy)
@@ -74,22 +162,39 @@ func (m *Migrator) ClusterVersion(host string, auth *Auth, proxy string) (*Clust
 
 	if errs != nil {
 		log.Error(errs)
-		return nil, errs
+		return nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 
 	log.Debug(body)
 
+	if resp.StatusCode != 200 {
+		return nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
+	}
+
 	version := &ClusterVersion{}
 	err := json.Unmarshal([]byte(body), version)
 
 	if err != nil {
-		log.Error(body, errs)
-		return nil, errs
+		log.Error(body, err)
+		return nil, &DecodeError{Body: body, Err: err}
 	}
 	return version, nil
 }
 
-func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy string, compress bool) ESAPI {
+// versionOf returns the major and minor version of the cluster behind api
+func versionOf(api ESAPI) (major int, minor int) {
+	if api == nil || api.ClusterVersion() == nil {
+		return 0, 0
+	}
+	numbers := strings.SplitN(api.ClusterVersion().Version.Number, ".", 3)
+	major, _ = strconv.Atoi(numbers[0])
+	if len(numbers) > 1 {
+		minor, _ = strconv.Atoi(numbers[1])
+	}
+	return major, minor
+}
+
+func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy string, compress bool) (ESAPI, error) {
 	var auth *Auth = nil
 	if len(authStr) > 0 && strings.Contains(authStr, ":") {
 		authArray := strings.Split(authStr, ":")
@@ -101,14 +206,16 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		}
 	}
 
-	esVersion, errs := m.ClusterVersion(host, auth, proxy)
-	if errs != nil {
-		return nil
+	esVersion, err := m.ClusterVersion(host, auth, proxy)
+	if err != nil {
+		return nil, err
 	}
 
 	esInfo := "dest"
+	throttle := m.throttleBulkRetry
 	if isSource {
 		esInfo = "source"
+		throttle = nil
 	}
 
 	log.Infof("%s es version: %s", esInfo, esVersion.Version.Number)
@@ -120,7 +227,8 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Auth = auth
 		api.HttpProxy = proxy
 		api.Version = esVersion
-		return api
+		api.BulkRetryThrottle = throttle
+		return api, nil
 	} else if strings.HasPrefix(esVersion.Version.Number, "7.") {
 		log.Debug("es is V7,", esVersion.Version.Number)
 		api := new(ESAPIV7)
@@ -129,7 +237,8 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Auth = auth
 		api.HttpProxy = proxy
 		api.Version = esVersion
-		return api
+		api.BulkRetryThrottle = throttle
+		return api, nil
 		//migrator.SourceESAPI = api
 	} else if strings.HasPrefix(esVersion.Version.Number, "6.") {
 		log.Debug("es is V6,", esVersion.Version.Number)
@@ -139,7 +248,8 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Auth = auth
 		api.HttpProxy = proxy
 		api.Version = esVersion
-		return api
+		api.BulkRetryThrottle = throttle
+		return api, nil
 		//migrator.SourceESAPI = api
 	} else if strings.HasPrefix(esVersion.Version.Number, "5.") {
 		log.Debug("es is V5,", esVersion.Version.Number)
@@ -149,7 +259,8 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Auth = auth
 		api.HttpProxy = proxy
 		api.Version = esVersion
-		return api
+		api.BulkRetryThrottle = throttle
+		return api, nil
 		//migrator.SourceESAPI = api
 	} else {
 		log.Debug("es is not V5,", esVersion.Version.Number)
@@ -159,10 +270,17 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Auth = auth
 		api.HttpProxy = proxy
 		api.Version = esVersion
-		return api
+		api.BulkRetryThrottle = throttle
+		return api, nil
 	}
 }
 
+// throttleBulkRetry takes the tokens of the bulk items sent again, the first
+// try of the bulk took them in the bulk worker
+func (m *Migrator) throttleBulkRetry(docs int, size int) {
+	m.BulkThrottle.Wait(docs, size, m.stop)
+}
+
 func (m *Migrator) ClusterReady(api ESAPI) (*ClusterHealth, bool) {
 	health := api.ClusterHealth()
 
@@ -193,6 +311,8 @@ func (m *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 	mainBuf := bytes.Buffer{}
 	docBuf := bytes.Buffer{}
 	docEnc := json.NewEncoder(&docBuf)
+	//checkpoint batches of the buffered documents
+	acks := []*scrollBatch{}
 
 	idleDuration := 5 * time.Second
 	idleTimeout := time.NewTimer(idleDuration)
@@ -206,6 +326,7 @@ func (m *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 	if reflect.TypeOf(m.TargetESAPI).String() == "*main.ESAPIV8" {
 		haveTypeField = false
 	}
+	metaKeys := bulkMetadataKeys(m.TargetESAPI)
 	/*
 		checkKeys := []string{"_index", "_type", "_source", "_id"}
 		if !haveTypeField {
@@ -234,6 +355,10 @@ READ_DOCS:
 			if m.Config.OverrideTypeName != "" {
 				tempTargetTypeName = m.Config.OverrideTypeName
 			}
+			if len(m.Config.SplitTypes) > 0 {
+				tempDestIndexName = m.splitIndexName(src.Index, src.Type)
+				tempTargetTypeName = m.singleTypeName()
+			}
 			doc := Document{
 				Index: tempDestIndexName,
 				//Type:   tempTargetTypeName,
@@ -241,6 +366,20 @@ READ_DOCS:
 				Id:      src.Id,
 				Routing: src.Routing,
 			}
+			//the routing of the hits is only kept when asked, or to join
+			if m.Config.CopyMetadata {
+				doc.Routing = src.routing()
+			}
+			//all the types of a joined index are merged into one
+			if _, joined := m.joinTypes[src.Index]; joined && len(m.Config.JoinField) > 0 {
+				tempTargetTypeName = m.singleTypeName()
+				src.Source, doc.Routing, err = m.joinDocument(&src, src.routing())
+				if err != nil {
+					log.Errorf("failed to join document %s/%s/%s: %v", src.Index, src.Type, src.Id, err)
+					src.checkpoint.Ack()
+					continue
+				}
+			}
 			if haveTypeField {
 				doc.Type = tempTargetTypeName
 			}
@@ -270,26 +409,29 @@ READ_DOCS:
 			// sanity check
 			if len(doc.Index) == 0 || len(doc.Type) == 0 && haveTypeField {
 				log.Errorf("failed decoding document: %+v", doc)
+				src.checkpoint.Ack()
 				continue
 			}
 
 			// encode the doc and and the _source field for a bulk request
-			post := map[string]Document{
-				"index": doc,
-			}
+			post := m.bulkAction("index", doc, &src, metaKeys)
 			if err = docEnc.Encode(post); err != nil {
 				log.Error(err)
 			}
 			// append the doc to the main buffer
 			mainBuf.Write(docBuf.Bytes())
 			mainBuf.Write(src.Source)
+			mainBuf.WriteByte('\n')
+			if src.checkpoint != nil {
+				acks = append(acks, src.checkpoint)
+			}
 			// reset for next document
 			bulkItemSize++
 			(*docCount)++
 			docBuf.Reset()
 
 			// if we approach the 100mb es limit, flush to es and reset mainBuf
-			if mainBuf.Len()+docBuf.Len() > (m.Config.BulkSizeInMB * 1024 * 1024) {
+			if mainBuf.Len()+docBuf.Len() > m.bulkSizeLimit() {
 				goto CLEAN_BUFFER
 			}
 
@@ -304,7 +446,8 @@ READ_DOCS:
 		goto READ_DOCS
 
 	CLEAN_BUFFER:
-		m.TargetESAPI.Bulk(&mainBuf)
+		m.bulkAndAck(&mainBuf, bulkItemSize, acks)
+		acks = acks[:0]
 		log.Trace("clean buffer, and execute bulk insert")
 		pb.Add(bulkItemSize)
 		bulkItemSize = 0
@@ -317,71 +460,159 @@ WORKER_DONE:
 		mainBuf.Write(docBuf.Bytes())
 		bulkItemSize++
 	}
-	m.TargetESAPI.Bulk(&mainBuf)
+	m.bulkAndAck(&mainBuf, bulkItemSize, acks)
 	log.Trace("bulk insert")
 	pb.Add(bulkItemSize)
 	bulkItemSize = 0
 	wg.Done()
 }
 
-func (m *Migrator) bulkRecords(bulkOp BulkOperation, dstEsApi ESAPI, targetIndex string, targetType string, diffDocMaps map[string]json.RawMessage) error {
-	//var err error
+// setError records an error which leaves the migration incomplete
+func (m *Migrator) setError(err error) {
+	m.errLock.Lock()
+	defer m.errLock.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *Migrator) Err() error {
+	m.errLock.Lock()
+	defer m.errLock.Unlock()
+	return m.err
+}
+
+// bulk sends the buffered documents to the target and keeps count of the outcome
+func (m *Migrator) bulk(data *bytes.Buffer, docs int) error {
+	if data.Len() == 0 {
+		return nil
+	}
+	m.Pressure.Wait(m.stop)
+	m.BulkThrottle.Wait(docs, data.Len(), m.stop)
+	var result *BulkResult
+	var err error
+	if m.BulkController != nil {
+		epoch := m.BulkController.Acquire()
+		start := time.Now()
+		result, err = m.TargetESAPI.Bulk(data)
+		m.BulkController.Release(epoch, time.Since(start), result, err)
+	} else {
+		result, err = m.TargetESAPI.Bulk(data)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+	m.recordBulkResult(result)
+	return err
+}
+
+func (m *Migrator) bulkSizeLimit() int {
+	if m.BulkController != nil {
+		return m.BulkController.BulkSize()
+	}
+	return m.Config.BulkSizeInMB * 1024 * 1024
+}
+
+// bulkAndAck sends the buffer and acknowledges its documents to the
+// checkpoint. The checkpoint of the slices of a failed bulk can't move past
+// it any more, the run fails so that --resume reads them again
+func (m *Migrator) bulkAndAck(data *bytes.Buffer, docs int, acks []*scrollBatch) {
+	err := m.bulk(data, docs)
+	if err == nil {
+		ackDocs(acks)
+		return
+	}
+	if len(acks) > 0 {
+		log.Errorf("bulk of %d documents failed, the checkpoint stops before them: %v", docs, err)
+		m.setError(err)
+	}
+}
+
+// ackDocs tells the checkpoint the documents were handled by the target
+func ackDocs(batches []*scrollBatch) {
+	for _, batch := range batches {
+		batch.Ack()
+	}
+}
+
+func (m *Migrator) recordBulkResult(result *BulkResult) {
+	if result == nil {
+		return
+	}
+	atomic.AddInt64(&m.SucceededDocs, int64(result.Succeeded))
+	atomic.AddInt64(&m.RetriedDocs, int64(result.Retried))
+	atomic.AddInt64(&m.FailedDocs, int64(len(result.Failed)))
+	if m.DeadLetter != nil {
+		m.DeadLetter.Write(result.Failed)
+	}
+}
+
+func (m *Migrator) logBulkSummary() {
+	failed := atomic.LoadInt64(&m.FailedDocs)
+	msg := fmt.Sprintf("bulk finished, indexed: %d, failed: %d, retried: %d",
+		atomic.LoadInt64(&m.SucceededDocs), failed, atomic.LoadInt64(&m.RetriedDocs))
+	if m.Pressure != nil {
+		pauses, pausedTime := m.Pressure.Summary()
+		msg += fmt.Sprintf(", paused: %d times for %s", pauses, pausedTime.Round(time.Second))
+	}
+	if failed > 0 {
+		log.Warn(msg)
+	} else {
+		log.Info(msg)
+	}
+}
+
+// bulkRecords writes docs into targetIndex, each with its id, type and
+// routing, the sources of deleted documents are ignored
+func (m *Migrator) bulkRecords(bulkOp BulkOperation, dstEsApi ESAPI, targetIndex string, docs []Document) error {
 	docCount := 0
-	bulkItemSize := 0
 	mainBuf := bytes.Buffer{}
 	docBuf := bytes.Buffer{}
 	docEnc := json.NewEncoder(&docBuf)
 	haveTypeField := true
-	//var tempDestIndexName string
-	//var tempTargetTypeName string
-
 	if reflect.TypeOf(dstEsApi).String() == "*main.ESAPIV8" {
 		haveTypeField = false
 	}
+	keys := bulkMetadataKeys(dstEsApi)
 
-	for docId, docData := range diffDocMaps {
-		log.Debugf("now will bulk %s docId=%s, docData=%+v", bulkOp, docId, docData)
-		//tempDestIndexName = docI["_index"].(string)
-		//tempTargetTypeName = docI["_type"].(string)
-		var strOperation string
-		doc := Document{
-			Index: targetIndex,
-			//Type:  targetType,
-			Id: docId, // docI["_id"].(string),
-		}
-		if haveTypeField {
-			doc.Type = targetType
-		}
-		switch bulkOp {
-		case opIndex:
-			strOperation = "index"
-		case opDelete:
-			strOperation = "delete"
-			//do nothing
-		}
+	strOperation := "index"
+	if bulkOp == opDelete {
+		strOperation = "delete"
+	}
+	for i := range docs {
+		doc := &docs[i]
+		log.Debugf("now will bulk %s docId=%s, docData=%s", bulkOp, doc.Id, doc.Source)
 
 		// encode the doc and and the _source field for a bulk request
-
-		post := map[string]Document{
-			strOperation: doc,
+		meta := map[string]interface{}{"_index": targetIndex, "_id": doc.Id}
+		if haveTypeField && len(doc.Type) > 0 {
+			meta["_type"] = doc.Type
 		}
-		_ = Verify(docEnc.Encode(post))
+		if routing := doc.routing(); len(routing) > 0 {
+			meta[keys.routing] = routing
+		}
+		_ = Verify(docEnc.Encode(map[string]interface{}{strOperation: meta}))
 		if bulkOp == opIndex {
-			_, _ = docBuf.Write(docData)
-			if docData[len(docData)-1] != byte('\n') {
+			_, _ = docBuf.Write(doc.Source)
+			if len(doc.Source) == 0 || doc.Source[len(doc.Source)-1] != byte('\n') {
 				_, _ = docBuf.Write([]byte{'\n'})
 			}
 		}
 		// append the doc to the main buffer
 		mainBuf.Write(docBuf.Bytes())
 		// reset for next document
-		bulkItemSize++
 		docCount++
 		docBuf.Reset()
 	}
 
 	if mainBuf.Len() > 0 {
-		_ = Verify(dstEsApi.Bulk(&mainBuf))
+		m.Pressure.Wait(m.stop)
+		m.BulkThrottle.Wait(docCount, mainBuf.Len(), m.stop)
+		result, err := dstEsApi.Bulk(&mainBuf)
+		m.recordBulkResult(result)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -397,269 +628,176 @@ func showDocs(message string, docs map[string]json.RawMessage) {
 	}
 }
 
-func (m *Migrator) SyncBetweenIndex(srcEsApi ESAPI, dstEsApi ESAPI, cfg *Config) {
-	// _id => value
-	srcDocMaps := make(map[string]json.RawMessage)
-	dstDocMaps := make(map[string]json.RawMessage)
-	diffDocMaps := make(map[string]json.RawMessage)
-	newDocMaps := make(map[string]json.RawMessage)
-
-	srcRecordIndex := 0
-	dstRecordIndex := 0
-	var err error
-	srcType := ""
-	dstType := ""
-	var srcScroll ScrollAPI = nil
-	var dstScroll ScrollAPI = nil
-	//var emptyScroll = &EmptyScroll{}
-	lastSrcId := ""
-	lastDestId := ""
-	needScrollSrc := true
-	needScrollDest := true
-
-	addCount := 0
-	updateCount := 0
-	deleteCount := 0
-
-	//TODO: 进度计算,分为 [ scroll src/dst + index ] => delete 几个部分
+// SyncBetweenIndex reads the ids and the hashes of the sources of both
+// indices, without sort, into sorted runs on disk. The ids are spread in
+// --sliced_scroll_size buckets by their hash, the same on both sides, and the
+// runs of each bucket are merged and joined on the id and the type in their
+// own goroutine:
+// the documents only in the source are added, the ones whose hash differs
+// are updated, and the ones only in the target deleted. Only the sources of
+// the added and updated documents are fetched, by _mget
+func (m *Migrator) SyncBetweenIndex(srcEsApi ESAPI, dstEsApi ESAPI, cfg *Config, pair *syncPair) error {
 	srcBar := pb.New(1).Prefix("Progress")
-	//srcBar := pb.New(1).Prefix("Source")
-	//dstBar := pb.New(100).Prefix("Dest")
-	//pool, err := pb.StartPool(srcBar, dstBar)
-
-	for {
-		if srcScroll == nil {
-			srcScroll, err = srcEsApi.NewScroll(cfg.SourceIndexNames, cfg.ScrollTime, cfg.DocBufferCount, cfg.Query,
-				cfg.SortField, 0, cfg.ScrollSliceSize, cfg.Fields)
-			if err != nil {
-				log.Errorf("can not scroll for source index: %s, reason:%s", cfg.SourceIndexNames, err.Error())
-				return
-			}
-			log.Infof("src total count=%d", srcScroll.GetHitsTotal())
-			srcBar.Total = int64(srcScroll.GetHitsTotal())
-			srcBar.Start()
-		} else if needScrollSrc {
-			start := time.Now()
-			log.Debugf("source index: %s next scroll, source id: %s", cfg.SourceIndexNames, srcScroll.GetScrollId())
-			srcScroll = VerifyWithResult(srcEsApi.NextScroll(cfg.ScrollTime, srcScroll.GetScrollId())).(ScrollAPI)
-			if cfg.Dry {
-				elapsed := time.Since(start)
-				fmt.Printf("src scroll : %s\n", elapsed)
-			}
+	srcBar.NotPrint = !pair.showBar
+	srcBar.Start()
+	defer func() {
+		if pair.showBar {
+			srcBar.FinishPrint("Source End")
+		} else {
+			srcBar.Finish()
 		}
+	}()
 
-		if dstScroll == nil {
-			dstScroll, err = dstEsApi.NewScroll(cfg.TargetIndexName, cfg.ScrollTime, cfg.DocBufferCount, cfg.Query,
-				cfg.SortField, 0, cfg.ScrollSliceSize, cfg.Fields)
-			if err != nil {
-				log.Errorf("can not scroll for dest index: %s, , reason:%s", cfg.TargetIndexName, err.Error())
-				return
-			} else {
-				//有 dest index,
-				//dstBar.Total = int64(dstScroll.GetHitsTotal()) // pb.New(dstScroll.GetHitsTotal()).Prefix("Dest")
-			}
-			//dstBar.Start()
-			log.Infof("dst total count=%d", dstScroll.GetHitsTotal())
-		} else if needScrollDest {
-			start := time.Now()
-			log.Debugf("source index: %s next scroll, source id: %s", cfg.TargetIndexName, dstScroll.GetScrollId())
-			dstScroll = VerifyWithResult(dstEsApi.NextScroll(cfg.ScrollTime, dstScroll.GetScrollId())).(ScrollAPI)
-			if cfg.Dry {
-				elapsed := time.Since(start)
-				fmt.Printf("dest scroll : %s\n", elapsed)
-			}
-		}
+	buckets := cfg.ScrollSliceSize
+	if buckets < 1 {
+		buckets = 1
+	}
+	srcRuns := newRunBuckets(cfg.SyncTmpDir, "esm-src", buckets, cfg.SyncRunSize)
+	defer srcRuns.remove()
+	srcTotal, err := m.scrollRuns(srcEsApi, pair.source, srcRuns, srcBar)
+	if err != nil {
+		return fmt.Errorf("can not scroll for source index: %s, reason: %w", pair.source, err)
+	}
+	log.Infof("src total count=%d", srcTotal)
 
-		//从目标 index 中查询,并放入 destMap, 如果没有则是空
-		if needScrollDest {
-			start := time.Now()
-			for idx, dstDoc := range dstScroll.GetDocs() {
-				destId := dstDoc.Id
-				dstSource := dstDoc.Source
-				lastDestId = destId
-				log.Debugf("dst [%d]: dstId=%s", dstRecordIndex+idx, destId)
-
-				if srcSource, found := srcDocMaps[destId]; found {
-					delete(srcDocMaps, destId)
-
-					//如果从 src 的 map 中找到匹配地项
-					if !cfg.IgnoreContentCompare && !bytes.Equal(srcSource, dstSource) {
-						//不相等, 则需要更新
-						diffDocMaps[destId] = srcSource
-						if cfg.Dry {
-							//diff := cmp.Diff(srcSource, dstSource)
-							//log.Infof("%s diff: %s", destId, diff)
-						}
-
-					} else {
-						//完全相等, 则不需要处理
-					}
-				} else {
-					// 没有从 src 的 map 中找到匹配地项, 先放入 dstDocMaps 中等待后续对比
-					dstDocMaps[destId] = dstSource
-				}
-				//dstBar.Increment()
-			}
-			dstRecordIndex += len(dstScroll.GetDocs())
-			if cfg.Dry {
-				elapsed := time.Since(start)
-				fmt.Printf("dest compare : %s\n", elapsed)
-			}
-		}
+	dstRuns := newRunBuckets(cfg.SyncTmpDir, "esm-dst", buckets, cfg.SyncRunSize)
+	defer dstRuns.remove()
+	dstTotal, err := m.scrollRuns(dstEsApi, pair.target, dstRuns, nil)
+	if err != nil {
+		return fmt.Errorf("can not scroll for dest index: %s, reason: %w", pair.target, err)
+	}
+	log.Infof("dst total count=%d", dstTotal)
+	if m.Stopping() {
+		return nil
+	}
 
-		//先将 src 的当前批次查出并放入 map
-		if needScrollSrc {
-			start := time.Now()
-			for idx, srcDoc := range srcScroll.GetDocs() {
-				srcId := srcDoc.Id
-				srcSource := srcDoc.Source
-				//srcType = srcDocI.(map[string]interface{})["_type"].(string)
-				lastSrcId = srcId
-				log.Debugf("src [%d]: srcId=%s", srcRecordIndex+idx, srcId)
-
-				if len(lastDestId) == 0 {
-					//没有 destId, 表示 目标 index 中没有数据, 直接全部更新
-					newDocMaps[srcId] = srcSource
-				} else if dstSource, ok := dstDocMaps[srcId]; ok { //能从 dstDocMaps 中找到相同ID的数据
-					if !cfg.IgnoreContentCompare && !bytes.Equal(srcSource, dstSource) {
-						//不完全相同,需要更新,否则忽略
-						diffDocMaps[srcId] = srcSource
-					}
-					//从 dst 中删除相同的
-					delete(dstDocMaps, srcId)
-				} else {
-					//找不到相同的 id, 可能是 dst 还没找到, 或者 dst 中不存在
-					if srcId < lastDestId {
-						//dest 已经超过当前的 srcId, 表示 dst 中不存在
-						newDocMaps[srcId] = srcSource
-					} else {
-						// dest 可能还没有遍历到, 先放入 srcDocMaps 中等待后续对比
-						srcDocMaps[srcId] = srcSource
-					}
-				}
-				srcBar.Increment()
-			}
-			srcRecordIndex += len(srcScroll.GetDocs())
-			if cfg.Dry {
-				elapsed := time.Since(start)
-				fmt.Printf("src compare : %s\n", elapsed)
-			}
+	changes := make([]*syncChanges, buckets)
+	errs := make([]error, buckets)
+	wg := sync.WaitGroup{}
+	for i := 0; i < buckets; i++ {
+		changes[i] = newSyncChanges(m, srcEsApi, dstEsApi, pair)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.joinRuns(srcRuns.writers[i], dstRuns.writers[i], changes[i])
+		}(i)
+	}
+	wg.Wait()
+	for i := range changes {
+		pair.added += changes[i].adds
+		pair.updated += changes[i].updates
+		pair.deleted += changes[i].deletes
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
+	}
+	if !m.Stopping() {
+		m.DiffReport.Summary(pair)
+	}
 
-		if len(diffDocMaps) > 0 {
-			updateCount += len(diffDocMaps)
-			log.Debugf("now will bulk update %d records", len(diffDocMaps))
-			if !cfg.Dry {
-				_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, srcType, diffDocMaps))
-			} else {
-				showDocs("diff", diffDocMaps)
-			}
-			diffDocMaps = make(map[string]json.RawMessage)
+	log.Infof("sync %s(%d) to %s(%d), add=%d, update=%d, delete=%d, failed=%d",
+		pair.source, srcTotal, pair.target, dstTotal,
+		pair.added, pair.updated, pair.deleted, atomic.LoadInt64(&m.FailedDocs))
+	return nil
+}
+
+// joinRuns merges the runs of a bucket on both sides and joins them on the
+// id, and on the type the documents of the source have in the target
+func (m *Migrator) joinRuns(srcRuns *runWriter, dstRuns *runWriter, changes *syncChanges) error {
+	src, err := srcRuns.merge()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	dst, err := dstRuns.merge()
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+
+	srcEntry, err := src.next()
+	if err != nil {
+		return err
+	}
+	dstEntry, err := dst.next()
+	if err != nil {
+		return err
+	}
+	var srcGroup, dstGroup []*runEntry
+	for (srcEntry != nil || dstEntry != nil) && !m.Stopping() {
+		//the entries of the smallest id left, one per type, on both sides
+		var id string
+		if dstEntry == nil || srcEntry != nil && srcEntry.id < dstEntry.id {
+			id = srcEntry.id
+		} else {
+			id = dstEntry.id
 		}
-		if len(newDocMaps) > 0 {
-			addCount += len(newDocMaps)
-			log.Debugf("now will bulk index %d records", len(diffDocMaps))
-			if !cfg.Dry {
-				_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, srcType, newDocMaps))
-			} else {
-				showDocs("new", newDocMaps)
+		srcGroup, dstGroup = srcGroup[:0], dstGroup[:0]
+		for srcEntry != nil && srcEntry.id == id {
+			srcGroup = append(srcGroup, srcEntry)
+			if srcEntry, err = src.next(); err != nil {
+				return err
 			}
-			newDocMaps = make(map[string]json.RawMessage)
 		}
-
-		if len(srcDocMaps) > 0 && lastSrcId < lastDestId {
-			// dst 已经中已经没有更多的记录, 可以直接将所有的 src 都同步到 dst 中了,避免其中保存太多
-			addCount += len(srcDocMaps)
-			if !cfg.Dry {
-				_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, dstType, srcDocMaps))
-			} else {
-				showDocs("insert", srcDocMaps)
+		for dstEntry != nil && dstEntry.id == id {
+			dstGroup = append(dstGroup, dstEntry)
+			if dstEntry, err = dst.next(); err != nil {
+				return err
 			}
-			srcDocMaps = make(map[string]json.RawMessage)
 		}
-
-		if len(dstDocMaps) > 0 && lastSrcId > lastDestId {
-			//dstDocMaps 中还有记录,而且当前已经检测过所有的 src 记录, 说明这些 dst 记录是多余的,需要删除
-			deleteCount += len(dstDocMaps)
-			if !cfg.Dry && cfg.EnableDelete {
-				_ = Verify(m.bulkRecords(opDelete, dstEsApi, cfg.TargetIndexName, dstType, dstDocMaps))
-			}
-			if cfg.Dry {
-				showDocs("delete", dstDocMaps)
-			}
-			dstDocMaps = make(map[string]json.RawMessage)
+		if err = m.joinEntries(srcGroup, dstGroup, changes); err != nil {
+			return err
 		}
+	}
+	return changes.flush()
+}
 
-		if lastSrcId == lastDestId {
-			needScrollSrc = true
-			needScrollDest = true
-		} else if len(lastDestId) == 0 || lastSrcId < lastDestId {
-			//len(lastDestId) == 0 表示dest数据为空
-			//上一次要求遍历 dest,但遍历出空
-			needScrollSrc = true
-			needScrollDest = false
-		} else if lastSrcId > lastDestId {
-			//上一次要求遍历 src, 但遍历出空
-			needScrollSrc = false
-			needScrollDest = true
-		}
-		if needScrollSrc == true && len(srcScroll.GetDocs()) == 0 {
-			needScrollSrc = false
+// joinEntries joins the entries of one id on their type in the target. The
+// source types written with the same type in the target are one document
+// there, only the first of them is compared
+func (m *Migrator) joinEntries(srcGroup []*runEntry, dstGroup []*runEntry, changes *syncChanges) error {
+	matched := make([]bool, len(dstGroup))
+	for i, srcEntry := range srcGroup {
+		typ := changes.joinType(srcEntry, true)
+		duplicate := false
+		for _, other := range srcGroup[:i] {
+			duplicate = duplicate || changes.joinType(other, true) == typ
 		}
-		if needScrollDest == true && len(dstScroll.GetDocs()) == 0 {
-			needScrollDest = false
+		if duplicate {
+			log.Warnf("document %s of type %s is written over another type of it in %s, skip it",
+				srcEntry.id, srcEntry.typ, changes.pair.target)
+			continue
 		}
 
-		//如果 src 和 dst 都遍历完毕, 才退出
-		log.Debugf("lastSrcId=%s, lastDestId=%s, "+
-			"needScrollSrc=%t, len(srcScroll.GetDocs()=%d, "+
-			"needScrollDest=%t, len(dstScroll.GetDocs())=%d",
-			lastSrcId, lastDestId,
-			needScrollSrc, len(srcScroll.GetDocs()),
-			needScrollDest, len(dstScroll.GetDocs()))
-
-		if (!needScrollSrc || len(srcScroll.GetDocs()) == 0) &&
-			(!needScrollDest || len(dstScroll.GetDocs()) == 0) {
-			log.Debugf("can not find more, will quit, and index %d, delete %d", len(srcDocMaps), len(dstDocMaps))
-
-			if len(srcDocMaps) > 0 {
-				addCount += len(srcDocMaps)
-				if !cfg.Dry {
-					_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, srcType, srcDocMaps))
-				} else {
-					showDocs("insert", srcDocMaps)
-				}
+		var dstEntry *runEntry
+		for j, e := range dstGroup {
+			if !matched[j] && changes.joinType(e, false) == typ {
+				dstEntry, matched[j] = e, true
+				break
 			}
-			if len(dstDocMaps) > 0 {
-				//最后在 dst 中还有遗留的,表示 dst 中多的.需要删除
-				deleteCount += len(dstDocMaps)
-				if !cfg.Dry && cfg.EnableDelete {
-					_ = Verify(m.bulkRecords(opDelete, dstEsApi, cfg.TargetIndexName, srcType, dstDocMaps))
-				}
-				if cfg.Dry {
-					showDocs("delete", dstDocMaps)
-				}
-			}
-			break
 		}
-
-		//目标不存在 或 src 还没有查询到和 dest 一样的地方
-		if cfg.SleepSecondsAfterEachBulk > 0 {
-			time.Sleep(time.Duration(cfg.SleepSecondsAfterEachBulk) * time.Second)
+		var err error
+		if dstEntry == nil {
+			//only in the source
+			err = changes.add(srcEntry)
+		} else if !m.Config.IgnoreContentCompare && srcEntry.hash != dstEntry.hash {
+			err = changes.update(srcEntry, dstEntry)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	srcEsApi.DeleteScroll(srcScroll.GetScrollId())
-	dstEsApi.DeleteScroll(dstScroll.GetScrollId())
-
-	srcBar.FinishPrint("Source End")
-	//dstBar.FinishPrint("Dest End")
-	//pool.Stop()
-
-	log.Infof("sync %s(%d) to %s(%d), add=%d, update=%d, delete=%d",
-		cfg.SourceIndexNames, srcRecordIndex, cfg.TargetIndexName, dstRecordIndex,
-		addCount, updateCount, deleteCount)
-
-	//log.Infof("diffDocMaps=%+v", diffDocMaps)
+	for j, dstEntry := range dstGroup {
+		//only in the target
+		if !matched[j] {
+			if err := changes.delete(dstEntry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (m *Migrator) DiffCounts(srcEsApi ESAPI, dstEsApi ESAPI) {
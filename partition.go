@@ -0,0 +1,107 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"math"
+)
+
+// partitionWindow is a range of the partition field read by its own scroll,
+// the documents without the field are read by a last window with no range
+type partitionWindow struct {
+	id     int
+	clause map[string]interface{}
+}
+
+func (w *partitionWindow) String() string {
+	return fmt.Sprintf("window %d %v", w.id, w.clause)
+}
+
+// partitionWindows splits the range of the partition field of an index into
+// N windows of the same width, plus one for the documents missing the field
+func (m *Migrator) partitionWindows(indexName string) ([]*partitionWindow, error) {
+	field := m.Config.PartitionField
+	partitions := m.Config.Partitions
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	min, max, date, err := m.SourceESAPI.FieldRange(indexName, field)
+	if err != nil {
+		return nil, fmt.Errorf("can not get the range of %s on %s: %w", field, indexName, err)
+	}
+
+	windows := []*partitionWindow{}
+	if min != nil && max != nil {
+		log.Infof("partition %s on %s, from %v to %v in %d windows", indexName, field, *min, *max, partitions)
+		//dates and integers keep whole boundaries
+		whole := *min == math.Trunc(*min) && *max == math.Trunc(*max)
+		bound := func(i int) interface{} {
+			value := *min + (*max-*min)*float64(i)/float64(partitions)
+			if whole {
+				return int64(math.Floor(value))
+			}
+			return value
+		}
+		for i := 0; i < partitions; i++ {
+			window := map[string]interface{}{"gte": bound(i)}
+			if i == partitions-1 {
+				window["lte"] = *max
+				if whole {
+					window["lte"] = int64(*max)
+				}
+			} else {
+				window["lt"] = bound(i + 1)
+			}
+			windows = append(windows, &partitionWindow{
+				id:     i,
+				clause: m.rangeClause(field, window, date),
+			})
+		}
+	}
+
+	windows = append(windows, &partitionWindow{id: len(windows), clause: m.missingFieldClause(field)})
+	return windows, nil
+}
+
+// rangeClause matches the documents of field within bounds. The bounds of a
+// date are in epoch millis, they are said so for the dates with a custom
+// format, the format of range came in 2.0
+func (m *Migrator) rangeClause(field string, bounds map[string]interface{}, date bool) map[string]interface{} {
+	if major, _ := versionOf(m.SourceESAPI); date && major >= 2 {
+		bounds["format"] = "epoch_millis"
+	}
+	return map[string]interface{}{"range": map[string]interface{}{field: bounds}}
+}
+
+// missingFieldClause matches the documents without field, 1.x only has the missing filter
+func (m *Migrator) missingFieldClause(field string) map[string]interface{} {
+	if major, _ := versionOf(m.SourceESAPI); major < 2 {
+		return map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"missing": map[string]interface{}{"field": field}},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+		},
+	}
+}
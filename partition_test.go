@@ -0,0 +1,112 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// versionAPI is a cluster of the given version
+func versionAPI(version string) ESAPI {
+	api := &ESAPIV0{Version: &ClusterVersion{}}
+	api.Version.Version.Number = version
+	return api
+}
+
+// rangeSource has the given range on every field
+type rangeSource struct {
+	ESAPI
+	min, max *float64
+	date     bool
+	err      error
+}
+
+func (s *rangeSource) FieldRange(indexNames string, field string) (*float64, *float64, bool, error) {
+	return s.min, s.max, s.date, s.err
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestPartitionWindows(t *testing.T) {
+	missing := map[string]interface{}{"bool": map[string]interface{}{
+		"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "f"}},
+	}}
+	rangeOf := func(bounds map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"range": map[string]interface{}{"f": bounds}}
+	}
+	cases := []struct {
+		name       string
+		version    string
+		partitions int
+		source     rangeSource
+		want       []map[string]interface{}
+	}{
+		{"integers", "5.6.16", 3, rangeSource{min: float(0), max: float(10)}, []map[string]interface{}{
+			rangeOf(map[string]interface{}{"gte": int64(0), "lt": int64(3)}),
+			rangeOf(map[string]interface{}{"gte": int64(3), "lt": int64(6)}),
+			rangeOf(map[string]interface{}{"gte": int64(6), "lte": int64(10)}),
+			missing,
+		}},
+		{"fractions", "5.6.16", 2, rangeSource{min: float(0.5), max: float(1.5)}, []map[string]interface{}{
+			rangeOf(map[string]interface{}{"gte": 0.5, "lt": 1.0}),
+			rangeOf(map[string]interface{}{"gte": 1.0, "lte": 1.5}),
+			missing,
+		}},
+		{"dates", "6.8.0", 1, rangeSource{min: float(1000), max: float(2000), date: true}, []map[string]interface{}{
+			rangeOf(map[string]interface{}{"gte": int64(1000), "lte": int64(2000), "format": "epoch_millis"}),
+			missing,
+		}},
+		{"1.x dates", "1.7.6", 1, rangeSource{min: float(1000), max: float(2000), date: true}, []map[string]interface{}{
+			rangeOf(map[string]interface{}{"gte": int64(1000), "lte": int64(2000)}),
+			{"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"missing": map[string]interface{}{"field": "f"}},
+			}},
+		}},
+		{"no values", "5.6.16", 4, rangeSource{}, []map[string]interface{}{missing}},
+	}
+	for _, c := range cases {
+		source := c.source
+		source.ESAPI = versionAPI(c.version)
+		m := &Migrator{Config: &Config{PartitionField: "f", Partitions: c.partitions}, SourceESAPI: &source}
+		windows, err := m.partitionWindows("index")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got := []map[string]interface{}{}
+		for i, window := range windows {
+			if window.id != i {
+				t.Errorf("%s: window %d has id %d", c.name, i, window.id)
+			}
+			got = append(got, window.clause)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPartitionWindowsRangeFailed(t *testing.T) {
+	source := &rangeSource{ESAPI: versionAPI("5.6.16"), err: errors.New("no such field")}
+	m := &Migrator{Config: &Config{PartitionField: "f", Partitions: 2}, SourceESAPI: source}
+	if windows, err := m.partitionWindows("index"); err == nil {
+		t.Errorf("got %d windows, want an error", len(windows))
+	}
+}
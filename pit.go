@@ -0,0 +1,186 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	ReaderAuto   = "auto"
+	ReaderScroll = "scroll"
+	ReaderPit    = "pit"
+)
+
+// PitAPI is implemented by the versions able to read with a point in time
+// and search_after, which unlike scroll keeps no context per page
+type PitAPI interface {
+	OpenPointInTime(indexNames string, keepAlive string) (string, error)
+	SearchPointInTime(body map[string]interface{}) (*PitScroll, error)
+	ClosePointInTime(id string) error
+}
+
+// pointInTimeSupported tells whether the cluster behind api is 7.12 or later,
+// point in time came in 7.10 but the _shard_doc tie breaker only in 7.12
+func pointInTimeSupported(api ESAPI) bool {
+	if _, ok := api.(PitAPI); !ok {
+		return false
+	}
+	major, minor := versionOf(api)
+	return major > 7 || major == 7 && minor >= 12
+}
+
+// usePointInTime picks the reader of the source from --reader
+func (m *Migrator) usePointInTime() (bool, error) {
+	switch m.Config.Reader {
+	case ReaderScroll:
+		return false, nil
+	case ReaderPit:
+		if !pointInTimeSupported(m.SourceESAPI) {
+			return false, fmt.Errorf("point in time needs elasticsearch 7.12 or later, source is %s",
+				m.SourceESAPI.ClusterVersion().Version.Number)
+		}
+		return true, nil
+	case ReaderAuto, "":
+		return pointInTimeSupported(m.SourceESAPI), nil
+	}
+	return false, fmt.Errorf("unknown reader [%s], should be one of: %s, %s, %s", m.Config.Reader, ReaderAuto, ReaderScroll, ReaderPit)
+}
+
+// PitScroll reads one slice of a point in time page after page, each page
+// continuing after the sort values of the last hit of the previous one.
+// _shard_doc breaks the ties of the sort field, so no hit is read twice
+type PitScroll struct {
+	ScrollV7
+	PitId string `json:"pit_id,omitempty"`
+
+	api  PitAPI
+	body map[string]interface{}
+}
+
+// NewPitScroll opens a point in time on indexNames and reads its first page
+func NewPitScroll(api PitAPI, indexNames string, keepAlive string, docBufferCount int, query string, sort string,
+	slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (*PitScroll, error) {
+
+	pitId, err := api.OpenPointInTime(indexNames, keepAlive)
+	if err != nil {
+		return nil, err
+	}
+
+	body := newScrollBody(query, "", slicedId, maxSlicedCount, fields, opts)
+	sorts := []interface{}{}
+	if len(sort) > 0 {
+		sorts = append(sorts, sort)
+	}
+	body["sort"] = append(sorts, "_shard_doc")
+	body["size"] = docBufferCount
+	body["pit"] = map[string]interface{}{"id": pitId, "keep_alive": keepAlive}
+	body["track_total_hits"] = true
+
+	scroll, err := api.SearchPointInTime(body)
+	if err != nil {
+		if closeErr := api.ClosePointInTime(pitId); closeErr != nil {
+			log.Warn(closeErr)
+		}
+		return nil, err
+	}
+	if len(scroll.PitId) == 0 {
+		scroll.PitId = pitId
+	}
+	scroll.api = api
+	scroll.body = body
+	//only the first page counts the hits
+	body["track_total_hits"] = false
+	return scroll, nil
+}
+
+func (s *PitScroll) GetScrollId() string {
+	return s.PitId
+}
+
+func (s *PitScroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
+	if len(s.Hits.Docs) == 0 {
+		return true
+	}
+
+	s.body["search_after"] = s.Hits.Docs[len(s.Hits.Docs)-1].Sort
+	s.body["pit"].(map[string]interface{})["id"] = s.PitId
+	page, err := s.api.SearchPointInTime(s.body)
+	if err != nil {
+		//the request was already retried, give up on this slice
+		s.stop(c, err)
+		return true
+	}
+
+	//the id of the point in time may change from page to page
+	if len(page.PitId) > 0 {
+		s.PitId = page.PitId
+	}
+	s.Shards = page.Shards
+	s.Hits.Docs = page.Hits.Docs
+	if len(s.Hits.Docs) == 0 {
+		log.Debug("search after result is empty")
+		return true
+	}
+
+	s.ProcessScrollResult(c, bar)
+	return s.slice != nil && s.slice.err != nil
+}
+
+// resume reads the page after searchAfter again on the same point in time,
+// the _shard_doc tie breaker makes it continue exactly after the last hit
+// delivered. Without searchAfter the slice is read from its start
+func (s *PitScroll) resume(searchAfter []interface{}) error {
+	if len(searchAfter) > 0 {
+		s.body["search_after"] = searchAfter
+	} else {
+		delete(s.body, "search_after")
+	}
+	s.body["pit"].(map[string]interface{})["id"] = s.PitId
+	page, err := s.api.SearchPointInTime(s.body)
+	if err != nil {
+		return err
+	}
+	if len(page.PitId) > 0 {
+		s.PitId = page.PitId
+	}
+	s.Shards = page.Shards
+	s.Hits.Docs = page.Hits.Docs
+	return nil
+}
+
+// Close releases the point in time
+func (s *PitScroll) Close() error {
+	if len(s.PitId) == 0 {
+		return nil
+	}
+	return s.api.ClosePointInTime(s.PitId)
+}
+
+// closeScroll releases the search context held by a scroll of the source
+func (m *Migrator) closeScroll(scroll ScrollAPI) {
+	pit, ok := scroll.(*PitScroll)
+	if !ok {
+		m.SourceESAPI.DeleteScroll(scroll.GetScrollId())
+		return
+	}
+	if err := pit.Close(); err != nil {
+		log.Warnf("failed to close the point in time: %v", err)
+	}
+}
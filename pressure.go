@@ -0,0 +1,175 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeThreadPools are the thread pools handling bulk requests, named bulk
+// before 6.3 and write since, index for the single document requests of 1.x
+var writeThreadPools = []string{"write", "bulk", "index"}
+
+// PressureMonitor polls the target while the migration runs and holds the
+// bulk workers back while the cluster is red or rejecting writes
+type PressureMonitor struct {
+	api           ESAPI
+	interval      time.Duration
+	maxRejections int64
+	maxWriteQueue int
+
+	lock        sync.Mutex
+	resume      chan struct{} //closed while not paused
+	pausedSince time.Time
+	pauses      int
+	pausedTime  time.Duration
+	rejected    map[string]int64 //rejections of each node at the last check
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewPressureMonitor(api ESAPI, c *Config) *PressureMonitor {
+	interval := time.Duration(c.PressureCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	p := &PressureMonitor{
+		api:           api,
+		interval:      interval,
+		maxRejections: c.PressureMaxRejections,
+		maxWriteQueue: c.PressureMaxWriteQueue,
+		resume:        make(chan struct{}),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	close(p.resume)
+	return p
+}
+
+// Start polls the target in the background until Stop
+func (p *PressureMonitor) Start() {
+	//take the current rejection counters as the baseline
+	p.check()
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.check()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the polling and releases the waiting workers
+func (p *PressureMonitor) Stop() {
+	close(p.stop)
+	<-p.done
+	p.setPaused(false, "")
+}
+
+// Wait blocks while the target is under pressure, or until stop is closed
+func (p *PressureMonitor) Wait(stop <-chan struct{}) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	resume := p.resume
+	p.lock.Unlock()
+	select {
+	case <-resume:
+	case <-stop:
+	}
+}
+
+// Summary returns how many times and how long the bulk workers were paused
+func (p *PressureMonitor) Summary() (int, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pausedTime := p.pausedTime
+	if !p.pausedSince.IsZero() {
+		pausedTime += time.Since(p.pausedSince)
+	}
+	return p.pauses, pausedTime
+}
+
+func (p *PressureMonitor) check() {
+	reasons := []string{}
+
+	health := p.api.ClusterHealth()
+	if health.Status == "red" || health.Status == "unreachable" {
+		reasons = append(reasons, fmt.Sprintf("cluster health is %s", health.Status))
+	}
+
+	stats, err := p.api.NodesThreadPoolStats()
+	if err != nil {
+		//a failed poll says nothing about the write load, keep the current state
+		log.Warnf("failed to get the thread pool stats of the target: %v", err)
+	} else {
+		rejected := map[string]int64{}
+		for id, node := range stats.Nodes {
+			queue := 0
+			for _, name := range writeThreadPools {
+				if pool, ok := node.ThreadPool[name]; ok {
+					queue += pool.Queue
+					rejected[id] += pool.Rejected
+				}
+			}
+			if p.maxWriteQueue > 0 && queue > p.maxWriteQueue {
+				reasons = append(reasons, fmt.Sprintf("node %s write queue: %d", node.Name, queue))
+			}
+			//counters restart from 0 with the node
+			if last, ok := p.rejected[id]; ok && rejected[id] >= last && rejected[id]-last > p.maxRejections {
+				reasons = append(reasons, fmt.Sprintf("node %s rejected %d writes", node.Name, rejected[id]-last))
+			}
+		}
+		p.rejected = rejected
+	}
+
+	p.setPaused(len(reasons) > 0, strings.Join(reasons, ", "))
+}
+
+func (p *PressureMonitor) setPaused(paused bool, reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	wasPaused := !p.pausedSince.IsZero()
+	switch {
+	case paused && !wasPaused:
+		p.pauses++
+		p.pausedSince = time.Now()
+		p.resume = make(chan struct{})
+		log.Warnf("target under pressure, pause bulk: %s", reason)
+	case paused && wasPaused:
+		log.Debugf("target still under pressure: %s", reason)
+	case !paused && wasPaused:
+		pausedFor := time.Since(p.pausedSince)
+		p.pausedTime += pausedFor
+		p.pausedSince = time.Time{}
+		close(p.resume)
+		log.Infof("target recovered, resume bulk after %s", pausedFor.Round(time.Second))
+	}
+}
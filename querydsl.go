@@ -0,0 +1,77 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"os"
+	"strings"
+)
+
+// parseQueryDSL reads --query_dsl, inline json or @file.json, either the
+// query itself or a search body wrapping it in "query"
+func parseQueryDSL(value string) (map[string]interface{}, error) {
+	data := []byte(value)
+	if strings.HasPrefix(value, "@") {
+		var err error
+		data, err = os.ReadFile(value[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&query); err != nil {
+		return nil, fmt.Errorf("invalid query dsl: %v", err)
+	}
+	if inner, ok := query["query"].(map[string]interface{}); ok && len(query) == 1 {
+		query = inner
+	}
+	if len(query) == 0 {
+		return nil, fmt.Errorf("empty query dsl")
+	}
+	return query, nil
+}
+
+// scrollOptions adds the query dsl to opts, it is combined with --query and
+// the resume filter, or used verbatim when alone, and the metadata to read
+func (m *Migrator) scrollOptions(opts ...ScrollOption) []ScrollOption {
+	if m.QueryDSL != nil {
+		opts = append(opts, WithFilter(m.QueryDSL))
+	}
+	if m.Config.CopyMetadata || len(m.Config.JoinField) > 0 {
+		opts = append(opts, m.metadataOption())
+	}
+	return opts
+}
+
+// validateQueryDSL checks the query dsl against the source before anything is read
+func (m *Migrator) validateQueryDSL(api ESAPI, indexNames string) error {
+	if m.QueryDSL == nil {
+		return nil
+	}
+	if err := api.ValidateQuery(indexNames, m.QueryDSL); err != nil {
+		return fmt.Errorf("query dsl is not valid on %s: %w", indexNames, err)
+	}
+	log.Debugf("query dsl is valid on %s", indexNames)
+	return nil
+}
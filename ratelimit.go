@@ -0,0 +1,101 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket refilled at rate tokens per second, holding
+// at most one second worth of tokens. A request larger than what is left
+// takes the tokens in advance and waits for the bucket to refill, so that
+// bulk requests bigger than the rate still go through at the right pace
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns nil when rate is not positive, which means no limit
+func NewRateLimiter(rate int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long to wait before using them
+func (r *RateLimiter) reserve(n int) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// Throttle limits both the documents and the bytes per second, it is shared
+// by every goroutine on the same side of the migration
+type Throttle struct {
+	docs  *RateLimiter
+	bytes *RateLimiter
+}
+
+// NewThrottle returns nil when neither limit is set
+func NewThrottle(docsPerSec int, bytesPerSec int) *Throttle {
+	if docsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &Throttle{docs: NewRateLimiter(docsPerSec), bytes: NewRateLimiter(bytesPerSec)}
+}
+
+// Wait blocks until docs documents of size bytes may be sent, or stop is closed
+func (t *Throttle) Wait(docs int, size int, stop <-chan struct{}) {
+	if t == nil {
+		return
+	}
+	var delay time.Duration
+	if t.docs != nil {
+		delay = t.docs.reserve(docs)
+	}
+	if t.bytes != nil {
+		if d := t.bytes.reserve(size); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+}
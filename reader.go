@@ -0,0 +1,380 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// indexProgress keeps count of the reading of one source index
+type indexProgress struct {
+	name       string
+	slicesLeft int32
+	total      int64
+	read       int64
+	start      time.Time
+	started    sync.Once
+}
+
+// readTask reads one slice, or one partition window, of one source index
+type readTask struct {
+	index  *indexProgress
+	slice  int
+	window *partitionWindow
+}
+
+func (t *readTask) String() string {
+	if t.window != nil {
+		return fmt.Sprintf("window %d of %s", t.window.id, t.index.name)
+	}
+	return fmt.Sprintf("slice %d of %s", t.slice, t.index.name)
+}
+
+// planReadTasks reads the source indices matching -x smallest first, so they
+// are done early and leave the workers to the slices of the big ones.
+// Each index is read in slices, or in windows of --partition_field
+func (m *Migrator) planReadTasks(slices int) ([]*readTask, []*indexProgress, error) {
+	names, err := m.sourceIndices(m.Config.SourceIndexNames)
+	if err != nil {
+		//before 5.0 _cat has no json, read all of them as one
+		log.Warnf("can not list the source indices, read %s as a whole: %v", m.Config.SourceIndexNames, err)
+		names = []string{m.Config.SourceIndexNames}
+	}
+
+	tasks := []*readTask{}
+	progress := []*indexProgress{}
+	m.readProgress = map[string]*indexProgress{}
+	for _, name := range names {
+		index := &indexProgress{name: name}
+		progress = append(progress, index)
+		m.readProgress[name] = index
+		if len(names) == 1 {
+			m.readFallback = index
+		}
+		if len(m.Config.PartitionField) > 0 {
+			windows, err := m.partitionWindows(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, window := range windows {
+				tasks = append(tasks, &readTask{index: index, slice: window.id, window: window})
+			}
+			index.slicesLeft = int32(len(windows))
+			continue
+		}
+		for slice := 0; slice < slices; slice++ {
+			tasks = append(tasks, &readTask{index: index, slice: slice})
+		}
+		index.slicesLeft = int32(slices)
+	}
+	log.Infof("read %d indices in %d tasks", len(progress), len(tasks))
+	return tasks, progress, nil
+}
+
+// sourceIndices lists the open indices matching the pattern, smallest first.
+// Dot-indices are left out unless named or -a/--all is given
+func (m *Migrator) sourceIndices(pattern string) ([]string, error) {
+	indices, err := m.SourceESAPI.GetIndices(pattern)
+	if err != nil {
+		return nil, err
+	}
+	hidden := !m.Config.CopyAllIndexes && (pattern == "_all" || strings.ContainsAny(pattern, "*?"))
+	infos := []IndexInfo{}
+	for _, info := range *indices {
+		if info.Status == "close" || hidden && strings.HasPrefix(info.Index, ".") {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].DocsCount != infos[j].DocsCount {
+			return infos[i].DocsCount < infos[j].DocsCount
+		}
+		return infos[i].Index < infos[j].Index
+	})
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Index)
+	}
+	return names, nil
+}
+
+// startReaders runs the read tasks with a pool of workers, the doc chan is
+// closed once all of them are done
+func (m *Migrator) startReaders(tasks []*readTask, progress []*indexProgress, workers int, usePit bool,
+	fetchBar *pb.ProgressBar, outputBar *pb.ProgressBar, wg *sync.WaitGroup) {
+
+	if workers < 1 {
+		//by default, all the tasks of an index at once
+		for _, index := range progress {
+			if int(index.slicesLeft) > workers {
+				workers = int(index.slicesLeft)
+			}
+		}
+	}
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+
+	queue := make(chan *readTask, len(tasks))
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+
+	var totalSize int64
+	addTotal := func(size int) {
+		if size > 0 {
+			total := atomic.AddInt64(&totalSize, int64(size))
+			fetchBar.SetTotal64(total)
+			outputBar.SetTotal64(total)
+		}
+	}
+
+	done := make(chan struct{})
+	go m.reportReadProgress(progress, done)
+
+	readers := sync.WaitGroup{}
+	readers.Add(workers)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			defer readers.Done()
+			for task := range queue {
+				if m.Stopping() {
+					continue
+				}
+				m.runReadTask(task, m.Config.ScrollSliceSize, usePit, fetchBar, addTotal)
+			}
+		}()
+	}
+
+	go func() {
+		readers.Wait()
+		close(done)
+		log.Debug("closing doc chan")
+		close(m.DocChan)
+	}()
+}
+
+func (m *Migrator) runReadTask(task *readTask, slices int, usePit bool, fetchBar *pb.ProgressBar, addTotal func(int)) {
+	c := m.Config
+	index := task.index
+	index.started.Do(func() {
+		index.start = time.Now()
+		log.Infof("start reading index %s", index.name)
+	})
+	defer m.finishReadTask(task)
+
+	state := &sliceState{}
+	if m.Checkpoint != nil {
+		state.checkpoint = m.Checkpoint.Slice(index.name, task.slice)
+		position := state.checkpoint.Position()
+		if position.Done {
+			log.Infof("%s was finished by the previous run, skip", task)
+			return
+		}
+		if len(position.SortValue) > 0 && len(c.SortField) > 0 {
+			log.Infof("%s resumes from %v, %d documents done", task, position.SortValue, position.Docs)
+			state.lastSort = position.SortValue
+		} else if position.Docs > 0 {
+			log.Warnf("%s has no sort value to resume from, read it again", task)
+		}
+	}
+
+	//scan before 5.0 ignores the sort and _id can't be read by range, without
+	//sort values a slice is read again from its start
+	_, scan := m.SourceESAPI.(*ESAPIV0)
+	sorted := len(c.SortField) > 0 && !scan && c.SortField != "_id"
+
+	//a window is read by one scroll, without slices
+	slice := task.slice
+	if task.window != nil {
+		slice, slices = 0, 1
+	}
+
+	//a point in time still open is continued after the last delivered hit
+	var pit *PitScroll
+	var pitDelivered int64 //documents delivered before the point in time was opened
+	for attempt := 0; ; attempt++ {
+		var scroll ScrollAPI
+		state.err = nil
+		if pit != nil {
+			//the sort values of the other points in time don't apply to this one
+			after := state.lastSort
+			if state.delivered == pitDelivered {
+				after = nil
+			}
+			scroll = pit
+			state.err = pit.resume(after)
+		} else {
+			opts := []ScrollOption{}
+			if task.window != nil {
+				opts = append(opts, WithFilter(task.window.clause))
+			}
+			if sorted && len(state.lastSort) > 0 {
+				opts = append(opts, WithSortFrom(c.SortField, state.lastSort))
+			}
+			opts = m.scrollOptions(opts...)
+
+			var err error
+			if usePit {
+				pitDelivered = state.delivered
+				pit, err = NewPitScroll(m.SourceESAPI.(PitAPI), index.name, c.ScrollTime, c.DocBufferCount,
+					c.Query, c.SortField, slice, slices, c.Fields, opts...)
+				scroll = pit
+			} else {
+				scroll, err = m.SourceESAPI.NewScroll(index.name, c.ScrollTime, c.DocBufferCount, c.Query,
+					c.SortField, slice, slices, c.Fields, opts...)
+			}
+			if err != nil {
+				log.Errorf("can not read %s: %v", task, err)
+				m.setError(err)
+				return
+			}
+		}
+		scroll.SetSlice(state)
+
+		if attempt == 0 {
+			atomic.AddInt64(&index.total, int64(scroll.GetHitsTotal()))
+			addTotal(scroll.GetHitsTotal())
+		}
+
+		delivered := state.delivered
+		if state.err == nil && scroll.GetDocs() != nil {
+			scroll.ProcessScrollResult(m, fetchBar)
+
+			// loop scrolling until done
+			for state.err == nil && !m.Stopping() && scroll.Next(m, fetchBar) == false {
+			}
+		}
+
+		//an expired point in time can't be continued, the slice is opened again
+		keepPit := pit != nil && state.err != nil && !m.Stopping() && !isSearchContextMissing(state.err)
+		if !keepPit {
+			m.closeScroll(scroll)
+			pit = nil
+		}
+
+		if state.err == nil || m.Stopping() {
+			break
+		}
+
+		//a slice making progress gets its attempts back
+		if state.delivered > delivered {
+			attempt = 0
+		}
+		if !m.recoverable(state.err) || attempt+1 >= retryPolicy.MaxAttempts {
+			log.Errorf("%s failed, stop reading it: %v", task, state.err)
+			m.setError(state.err)
+			if pit != nil {
+				m.closeScroll(pit)
+			}
+			return
+		}
+		delay := retryPolicy.Backoff(attempt)
+		if pit != nil {
+			log.Warnf("%s failed, continue it after %v in %s: %v", task, state.lastSort, delay, state.err)
+		} else if sorted && len(state.lastSort) > 0 {
+			state.reopen()
+			log.Warnf("%s failed, open it again from %v in %s: %v", task, state.lastSort, delay, state.err)
+		} else {
+			//the documents are written with their id, writing them again is harmless
+			log.Warnf("%s failed, read it again from its start in %s, %d documents are written again: %v",
+				task, delay, state.delivered, state.err)
+		}
+		time.Sleep(delay)
+	}
+
+	if state.checkpoint != nil && !m.Stopping() && m.Err() == nil {
+		state.checkpoint.Finish()
+	}
+}
+
+// recoverable tells whether a slice which stopped on err can be read again
+func (m *Migrator) recoverable(err error) bool {
+	//a lost scroll page is not asked again, the slice is opened again instead
+	if isSearchContextMissing(err) || isRetriableError(err) {
+		return true
+	}
+	var shardErr *ShardFailureError
+	if errors.As(err, &shardErr) {
+		return m.Config.ShardFailure == ShardFailureRetry
+	}
+	return false
+}
+
+// countRead adds the documents read from the source to the progress of their index
+func (m *Migrator) countRead(docs []Document) {
+	if len(m.readProgress) == 0 {
+		return
+	}
+	for _, doc := range docs {
+		index, ok := m.readProgress[doc.Index]
+		if !ok {
+			//read through an alias or a pattern
+			index = m.readFallback
+		}
+		if index != nil {
+			atomic.AddInt64(&index.read, 1)
+		}
+	}
+}
+
+func (m *Migrator) finishReadTask(task *readTask) {
+	index := task.index
+	if atomic.AddInt32(&index.slicesLeft, -1) > 0 {
+		return
+	}
+	if m.Stopping() {
+		log.Infof("index %s stopped, %d of %d documents read", index.name,
+			atomic.LoadInt64(&index.read), atomic.LoadInt64(&index.total))
+		return
+	}
+	log.Infof("index %s finished, %d of %d documents read in %s", index.name,
+		atomic.LoadInt64(&index.read), atomic.LoadInt64(&index.total), time.Since(index.start).Round(time.Second))
+}
+
+// reportReadProgress logs the progress of the indices being read until done is closed
+func (m *Migrator) reportReadProgress(progress []*indexProgress, done chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, index := range progress {
+				left := atomic.LoadInt32(&index.slicesLeft)
+				read := atomic.LoadInt64(&index.read)
+				if left <= 0 || read == 0 {
+					continue
+				}
+				log.Infof("index %s, %d of %d documents read", index.name, read, atomic.LoadInt64(&index.total))
+			}
+		}
+	}
+}
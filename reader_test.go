@@ -0,0 +1,388 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sortedDoc(id string, sort ...interface{}) Document {
+	return Document{Index: "index", Id: id, Sort: sort}
+}
+
+func docIds(docs []Document) []string {
+	ids := []string{}
+	for _, doc := range docs {
+		ids = append(ids, doc.Id)
+	}
+	return ids
+}
+
+// indexSource lists indices, or fails to with err
+type indexSource struct {
+	ESAPI
+	indices map[string]IndexInfo
+	err     error
+}
+
+func (s *indexSource) GetIndices(pattern string) (*map[string]IndexInfo, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &s.indices, nil
+}
+
+func TestSourceIndices(t *testing.T) {
+	source := &indexSource{indices: map[string]IndexInfo{
+		"logs-2":  {Index: "logs-2", Status: "open", DocsCount: 10},
+		"logs-1":  {Index: "logs-1", Status: "open", DocsCount: 20},
+		"logs-0":  {Index: "logs-0", Status: "close", DocsCount: 5},
+		".logs-3": {Index: ".logs-3", Status: "open", DocsCount: 1},
+	}}
+	cases := []struct {
+		pattern string
+		all     bool
+		want    []string
+	}{
+		{"*logs-*", false, []string{"logs-2", "logs-1"}},
+		{"*logs-*", true, []string{".logs-3", "logs-2", "logs-1"}},
+		{"_all", false, []string{"logs-2", "logs-1"}},
+	}
+	for _, c := range cases {
+		m := &Migrator{Config: &Config{CopyAllIndexes: c.all}, SourceESAPI: source}
+		names, err := m.sourceIndices(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, c.want) {
+			t.Errorf("%s, all=%v: got %v, want %v", c.pattern, c.all, names, c.want)
+		}
+	}
+}
+
+func TestSkipTied(t *testing.T) {
+	cases := []struct {
+		name   string
+		before []Document //delivered before the slice is opened again
+		after  []Document //read by the scroll opened again from the last sort value
+		want   []string
+	}{
+		{name: "no ties",
+			before: []Document{sortedDoc("a", 1), sortedDoc("b", 2)},
+			after:  []Document{sortedDoc("b", 2), sortedDoc("c", 3)},
+			want:   []string{"c"}},
+		{name: "ties delivered",
+			before: []Document{sortedDoc("a", 1), sortedDoc("b", 2), sortedDoc("c", 2)},
+			after:  []Document{sortedDoc("b", 2), sortedDoc("c", 2), sortedDoc("d", 3)},
+			want:   []string{"d"}},
+		{name: "ties left",
+			before: []Document{sortedDoc("a", 1), sortedDoc("b", 2)},
+			after:  []Document{sortedDoc("b", 2), sortedDoc("c", 2), sortedDoc("d", 2), sortedDoc("e", 3)},
+			want:   []string{"c", "d", "e"}},
+		{name: "ties in another order",
+			before: []Document{sortedDoc("b", 2), sortedDoc("c", 2)},
+			after:  []Document{sortedDoc("d", 2), sortedDoc("c", 2), sortedDoc("b", 2), sortedDoc("a", 3)},
+			want:   []string{"d", "a"}},
+		{name: "skip ends past the sort value",
+			before: []Document{sortedDoc("a", 1), sortedDoc("b", 2)},
+			after:  []Document{sortedDoc("b", 2), sortedDoc("c", 3), sortedDoc("d", 4)},
+			want:   []string{"c", "d"}},
+		{name: "nothing delivered",
+			after: []Document{sortedDoc("a", 1), sortedDoc("b", 1)},
+			want:  []string{"a", "b"}},
+		{name: "without sort values",
+			before: []Document{sortedDoc("a"), sortedDoc("b")},
+			after:  []Document{sortedDoc("a"), sortedDoc("b")},
+			want:   []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			slice := &sliceState{}
+			if delivered := slice.skipTied(c.before); len(delivered) != len(c.before) {
+				t.Fatalf("delivered %v before the reopen", docIds(delivered))
+			}
+			slice.reopen()
+			got := docIds(slice.skipTied(c.after))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("delivered %v after the reopen, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSkipTiedWithoutReopen(t *testing.T) {
+	//a page ending on a tie is followed by the next one, nothing is skipped
+	slice := &sliceState{}
+	slice.skipTied([]Document{sortedDoc("a", 1), sortedDoc("b", 2)})
+	got := docIds(slice.skipTied([]Document{sortedDoc("c", 2), sortedDoc("b", 2), sortedDoc("d", 3)}))
+	if want := []string{"c", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	if want := []string{"index//d"}; !reflect.DeepEqual(slice.tied, want) {
+		t.Errorf("tied %v, want %v", slice.tied, want)
+	}
+}
+
+var errContextMissing = &HTTPStatusError{StatusCode: 404, Body: `{"error":{"type":"search_context_missing_exception"}}`}
+
+// fakeSource serves docs, sorted by their first sort value, page after page.
+// The nth scroll it opens fails after fails[n] pages, and the nth search of a
+// point in time fails if it is pitFails
+type fakeSource struct {
+	ESAPI
+	docs     []Document
+	pageSize int
+	fails    []int
+	pitFails int
+	err      error
+	opened   []interface{}   //sort value each scroll was opened from, nil for the start
+	after    [][]interface{} //search_after of each search of a point in time
+	pits     int
+}
+
+func (s *fakeSource) failure() error {
+	if s.err != nil {
+		return s.err
+	}
+	return errContextMissing
+}
+
+// from returns the docs from the sort value of the range filter, if any
+func (s *fakeSource) from(query interface{}) (interface{}, []Document) {
+	clause, _ := query.(map[string]interface{})
+	r, ok := clause["range"].(map[string]interface{})
+	if !ok {
+		return nil, s.docs
+	}
+	var from interface{}
+	for _, bounds := range r {
+		from = bounds.(map[string]interface{})["gte"]
+	}
+	docs := []Document{}
+	for _, doc := range s.docs {
+		if doc.Sort[0].(int) >= from.(int) {
+			docs = append(docs, doc)
+		}
+	}
+	return from, docs
+}
+
+func (s *fakeSource) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
+	slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (ScrollAPI, error) {
+	body := newScrollBody(query, sort, slicedId, maxSlicedCount, fields, opts)
+	from, docs := s.from(body["query"])
+	failAfter := -1
+	if len(s.opened) < len(s.fails) {
+		failAfter = s.fails[len(s.opened)]
+	}
+	s.opened = append(s.opened, from)
+	return &fakeScroll{source: s, docs: docs, failAfter: failAfter}, nil
+}
+
+func (s *fakeSource) DeleteScroll(scrollId string) error {
+	return nil
+}
+
+func (s *fakeSource) OpenPointInTime(indexNames string, keepAlive string) (string, error) {
+	s.pits++
+	return fmt.Sprintf("pit-%d", s.pits), nil
+}
+
+func (s *fakeSource) ClosePointInTime(id string) error {
+	return nil
+}
+
+// SearchPointInTime serves the page after the search_after of the body, the
+// last sort value of the docs stands for _shard_doc
+func (s *fakeSource) SearchPointInTime(body map[string]interface{}) (*PitScroll, error) {
+	after, _ := body["search_after"].([]interface{})
+	s.after = append(s.after, after)
+	if len(s.after) == s.pitFails {
+		return nil, s.failure()
+	}
+	_, docs := s.from(body["query"])
+	start := 0
+	if len(after) > 0 {
+		for start < len(docs) && !reflect.DeepEqual(docs[start].Sort, after) {
+			start++
+		}
+		start++
+	}
+	page := &PitScroll{}
+	page.Hits.Total.Value = len(docs)
+	if start < len(docs) {
+		end := start + s.pageSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		page.Hits.Docs = docs[start:end]
+	}
+	return page, nil
+}
+
+type fakeScroll struct {
+	source    *fakeSource
+	docs      []Document
+	page      int
+	failAfter int
+	slice     *sliceState
+}
+
+func (s *fakeScroll) GetScrollId() string {
+	return ""
+}
+
+func (s *fakeScroll) GetHitsTotal() int {
+	return len(s.docs)
+}
+
+func (s *fakeScroll) GetDocs() []Document {
+	start := s.page * s.source.pageSize
+	if start >= len(s.docs) {
+		return []Document{}
+	}
+	end := start + s.source.pageSize
+	if end > len(s.docs) {
+		end = len(s.docs)
+	}
+	return s.docs[start:end]
+}
+
+func (s *fakeScroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
+	c.sendDocs(s.GetDocs(), s.slice)
+}
+
+func (s *fakeScroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
+	s.page++
+	if s.failAfter >= 0 && s.page >= s.failAfter {
+		s.slice.err = s.source.failure()
+		return true
+	}
+	if len(s.GetDocs()) == 0 {
+		return true
+	}
+	s.ProcessScrollResult(c, bar)
+	return false
+}
+
+func (s *fakeScroll) SetSlice(slice *sliceState) {
+	s.slice = slice
+}
+
+// readSlice reads the only slice of source, and returns the ids it delivered
+func readSlice(t *testing.T, source *fakeSource, sort string, usePit bool) (*Migrator, []string) {
+	t.Helper()
+	defer func(policy RetryPolicy) { retryPolicy = policy }(retryPolicy)
+	retryPolicy.BaseDelay, retryPolicy.Jitter = time.Millisecond, 0
+
+	m := &Migrator{
+		Config:      &Config{SortField: sort, DocBufferCount: source.pageSize, ScrollTime: "1m"},
+		SourceESAPI: source,
+		DocChan:     make(chan Document, 100),
+	}
+	task := &readTask{index: &indexProgress{name: "index", slicesLeft: 1}}
+	m.runReadTask(task, 1, usePit, pb.New(0), func(int) {})
+	close(m.DocChan)
+	ids := []string{}
+	for doc := range m.DocChan {
+		ids = append(ids, doc.Id)
+	}
+	return m, ids
+}
+
+func TestRunReadTaskReopen(t *testing.T) {
+	docs := []Document{sortedDoc("a", 1), sortedDoc("b", 2), sortedDoc("c", 2), sortedDoc("d", 2), sortedDoc("e", 3)}
+	cases := []struct {
+		name   string
+		sort   string
+		fails  []int
+		err    error
+		want   []string
+		opened []interface{}
+		failed bool
+	}{
+		{name: "no failure", sort: "ts",
+			want: []string{"a", "b", "c", "d", "e"}, opened: []interface{}{nil}},
+		{name: "reopened in a tie", sort: "ts", fails: []int{1},
+			want: []string{"a", "b", "c", "d", "e"}, opened: []interface{}{nil, 2}},
+		{name: "reopened twice in a tie", sort: "ts", fails: []int{1, 1},
+			want: []string{"a", "b", "c", "d", "e"}, opened: []interface{}{nil, 2, 2}},
+		{name: "read again without sort values", sort: "_id", fails: []int{1},
+			want: []string{"a", "b", "a", "b", "c", "d", "e"}, opened: []interface{}{nil, nil}},
+		{name: "not recoverable", sort: "ts", fails: []int{1}, err: &HTTPStatusError{StatusCode: 400},
+			want: []string{"a", "b"}, opened: []interface{}{nil}, failed: true},
+		{name: "attempts given back on progress", sort: "ts", fails: []int{1, 0, 0, 0, 0, 0, 0},
+			want: []string{"a", "b", "c"}, opened: []interface{}{nil, 2, 2, 2, 2, 2}, failed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := &fakeSource{docs: docs, pageSize: 2, fails: c.fails, err: c.err}
+			m, got := readSlice(t, source, c.sort, false)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("delivered %v, want %v", got, c.want)
+			}
+			if !reflect.DeepEqual(source.opened, c.opened) {
+				t.Errorf("opened from %v, want %v", source.opened, c.opened)
+			}
+			if failed := m.Err() != nil; failed != c.failed {
+				t.Errorf("failed is %v, want %v: %v", failed, c.failed, m.Err())
+			}
+		})
+	}
+}
+
+func TestRunReadTaskPointInTime(t *testing.T) {
+	docs := []Document{sortedDoc("a", 1, 0), sortedDoc("b", 2, 1), sortedDoc("c", 2, 2), sortedDoc("d", 2, 3), sortedDoc("e", 3, 4)}
+	cases := []struct {
+		name     string
+		pitFails int
+		err      error
+		pits     int
+		after    [][]interface{}
+	}{
+		{name: "no failure", pits: 1,
+			after: [][]interface{}{nil, {2, 1}, {2, 3}, {3, 4}}},
+		{name: "transient failure continues the point in time", pitFails: 2,
+			err: &TransportError{Err: errors.New("connection reset")}, pits: 1,
+			after: [][]interface{}{nil, {2, 1}, {2, 1}, {2, 3}, {3, 4}}},
+		{name: "expired point in time is opened again from the sort value", pitFails: 2, err: errContextMissing, pits: 2,
+			after: [][]interface{}{nil, {2, 1}, nil, {2, 2}, {3, 4}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := &fakeSource{docs: docs, pageSize: 2, pitFails: c.pitFails, err: c.err}
+			m, got := readSlice(t, source, "ts", true)
+			if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("delivered %v, want %v", got, want)
+			}
+			if source.pits != c.pits {
+				t.Errorf("opened %d points in time, want %d", source.pits, c.pits)
+			}
+			if !reflect.DeepEqual(source.after[:len(c.after)], c.after) {
+				t.Errorf("searched after %v, want %v", source.after, c.after)
+			}
+			if m.Err() != nil {
+				t.Error(m.Err())
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	log "github.com/cihub/seelog"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy is shared by every request to elasticsearch: scroll, bulk and
+// metadata calls, as well as the rejected items of a bulk request
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64 //fraction of the delay added or removed at random
+}
+
+var retryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.2,
+}
+
+// Backoff returns the delay before the next attempt, attempt starts at 0
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delta := float64(delay) * p.Jitter
+		delay += time.Duration(delta*2*rand.Float64() - delta)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// Retry calls fn until it succeeds, fails with an error not worth retrying,
+// or the attempts are exhausted
+func (p *RetryPolicy) Retry(method string, url string, fn func() error) error {
+	return p.RetryIf(method, url, isRetriableError, fn)
+}
+
+// RetryIf is Retry with the errors worth retrying told by retriable
+func (p *RetryPolicy) RetryIf(method string, url string, retriable func(err error) bool, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !retriable(err) || attempt+1 >= p.MaxAttempts {
+			return err
+		}
+		delay := p.Backoff(attempt)
+		log.Warnf("%s %s failed, attempt %d of %d, retry after %s: %v", method, SubString(url, 0, 200),
+			attempt+1, p.MaxAttempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func isRetriableStatus(statusCode int) bool {
+	switch statusCode {
+	case 429, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// isRejectedError tells whether the server refused the request without
+// handling it, so it is safe to send again even if it can't be replayed
+func isRejectedError(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == 429 || statusErr.StatusCode == 503
+	}
+	return false
+}
+
+func isRetriableError(err error) bool {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return isRetriableStatus(statusErr.StatusCode)
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	}
+	for _, c := range cases {
+		if got := policy.Backoff(c.attempt); got != c.want {
+			t.Errorf("attempt %d: got %s, want %s", c.attempt, got, c.want)
+		}
+	}
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := policy.Backoff(1); got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Fatalf("got %s with a jitter of 20%% of 200ms", got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := &HTTPStatusError{StatusCode: 503}
+	cases := []struct {
+		name  string
+		errs  []error
+		calls int
+		err   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"success after retries", []error{unavailable, &TransportError{Err: errors.New("reset")}, nil}, 3, nil},
+		{"not retriable", []error{&HTTPStatusError{StatusCode: 400}, nil}, 1, &HTTPStatusError{StatusCode: 400}},
+		{"attempts exhausted", []error{unavailable, unavailable, unavailable, nil}, 3, unavailable},
+	}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	for _, c := range cases {
+		calls := 0
+		err := policy.Retry("GET", "http://localhost:9200", func() error {
+			calls++
+			return c.errs[calls-1]
+		})
+		if calls != c.calls {
+			t.Errorf("%s: %d calls, want %d", c.name, calls, c.calls)
+		}
+		if fmt.Sprint(err) != fmt.Sprint(c.err) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestRetriableErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		retriable bool
+		rejected  bool
+	}{
+		{"transport", &TransportError{Err: errors.New("connection refused")}, true, false},
+		{"wrapped transport", fmt.Errorf("scroll: %w", &TransportError{Err: errors.New("eof")}), true, false},
+		{"too many requests", &HTTPStatusError{StatusCode: 429}, true, true},
+		{"bad gateway", &HTTPStatusError{StatusCode: 502}, true, false},
+		{"unavailable", &HTTPStatusError{StatusCode: 503}, true, true},
+		{"gateway timeout", &HTTPStatusError{StatusCode: 504}, true, false},
+		{"not found", &HTTPStatusError{StatusCode: 404}, false, false},
+		{"server error", &HTTPStatusError{StatusCode: 500}, false, false},
+		{"other", errors.New("decode"), false, false},
+	}
+	for _, c := range cases {
+		if got := isRetriableError(c.err); got != c.retriable {
+			t.Errorf("%s: retriable is %v, want %v", c.name, got, c.retriable)
+		}
+		if got := isRejectedError(c.err); got != c.rejected {
+			t.Errorf("%s: rejected is %v, want %v", c.name, got, c.rejected)
+		}
+	}
+}
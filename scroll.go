@@ -18,8 +18,17 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/cheggaaa/pb"
 	log "github.com/cihub/seelog"
+	"reflect"
+	"strings"
+)
+
+const (
+	ShardFailureRetry  = "retry"
+	ShardFailureAbort  = "abort"
+	ShardFailureIgnore = "ignore"
 )
 
 type ScrollAPI interface {
@@ -28,6 +37,121 @@ type ScrollAPI interface {
 	GetDocs() []Document
 	ProcessScrollResult(c *Migrator, bar *pb.ProgressBar)
 	Next(c *Migrator, bar *pb.ProgressBar) (done bool)
+	SetSlice(slice *sliceState)
+}
+
+// ScrollOption adds to the search body of a new scroll, on top of the query,
+// sort, slice and fields every version handles
+type ScrollOption func(req *scrollRequest)
+
+type scrollRequest struct {
+	filters []interface{}
+
+	version bool
+	fields  []string
+
+	scriptFields map[string]interface{}
+}
+
+// WithFilter only reads the documents which also match the query clause
+func WithFilter(clause map[string]interface{}) ScrollOption {
+	return func(req *scrollRequest) {
+		req.filters = append(req.filters, clause)
+	}
+}
+
+// WithMetadata asks for the version of the hits, and the metadata fields
+// 1.x/2.x only return when asked
+func WithMetadata(fields ...string) ScrollOption {
+	return func(req *scrollRequest) {
+		req.version = true
+		req.fields = fields
+	}
+}
+
+// WithDigest asks for a script field computed by the cluster instead of the
+// source of the hits
+func WithDigest(name string, script map[string]interface{}) ScrollOption {
+	return func(req *scrollRequest) {
+		if req.scriptFields == nil {
+			req.scriptFields = map[string]interface{}{}
+		}
+		req.scriptFields[name] = map[string]interface{}{"script": script}
+	}
+}
+
+// WithSortFrom continues a sorted read from the given sort value. The
+// documents of that value are read again, other documents may tie with the
+// last one read, the reader skips the ones it already delivered
+func WithSortFrom(sort string, sortValue []interface{}) ScrollOption {
+	return WithFilter(map[string]interface{}{
+		"range": map[string]interface{}{
+			sort: map[string]interface{}{"gte": sortValue[0]},
+		},
+	})
+}
+
+// newScrollBody builds the search body of a new scroll, shared by all the versions
+func newScrollBody(query string, sort string, slicedId int, maxSlicedCount int, fields string, opts []ScrollOption) map[string]interface{} {
+	queryBody := map[string]interface{}{}
+
+	if len(fields) > 0 {
+		if !strings.Contains(fields, ",") {
+			queryBody["_source"] = fields
+		} else {
+			queryBody["_source"] = strings.Split(fields, ",")
+		}
+	}
+
+	req := scrollRequest{}
+	for _, opt := range opts {
+		opt(&req)
+	}
+
+	clauses := []interface{}{}
+	if len(query) > 0 {
+		clauses = append(clauses, map[string]interface{}{
+			"query_string": map[string]interface{}{"query": query},
+		})
+	}
+	clauses = append(clauses, req.filters...)
+	if len(clauses) == 1 {
+		queryBody["query"] = clauses[0]
+	} else if len(clauses) > 1 {
+		queryBody["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{"must": clauses},
+		}
+	}
+
+	if req.version {
+		queryBody["version"] = true
+	}
+	if len(req.fields) > 0 {
+		queryBody["fields"] = req.fields
+	}
+	if len(req.scriptFields) > 0 {
+		queryBody["script_fields"] = req.scriptFields
+		queryBody["_source"] = false
+	}
+
+	if len(sort) > 0 {
+		sortFields := make([]string, 0)
+		sortFields = append(sortFields, sort)
+		queryBody["sort"] = sortFields
+	}
+
+	if maxSlicedCount > 1 {
+		log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
+		queryBody["slice"] = map[string]interface{}{}
+		queryBody["slice"].(map[string]interface{})["id"] = slicedId
+		queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
+	}
+
+	return queryBody
+}
+
+func (scroll *Scroll) SetSlice(slice *sliceState) {
+	scroll.slice = slice
 }
 
 func (scroll *Scroll) GetHitsTotal() int {
@@ -58,27 +182,30 @@ func (scroll *ScrollV7) GetDocs() []Document {
 // over
 func (s *Scroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 
+	// a page missing shards is not delivered, the slice is read again from
+	// the previous page, unless --shard_failure=ignore
+	if err := s.shardFailure(); err != nil {
+		if c.Config.ShardFailure != ShardFailureIgnore {
+			s.stop(c, err)
+			return
+		}
+		log.Error(err)
+	}
+
 	//update progress bar
 	bar.Add(len(s.Hits.Docs))
 
-	// show any failures
-	for _, failure := range s.Shards.Failures {
-		reason, _ := json.Marshal(failure.Reason)
-		log.Errorf(string(reason))
-	}
-
 	// write all the docs into a channel
-	for _, doc := range s.Hits.Docs {
-		c.DocChan <- doc
-	}
+	c.sendDocs(s.Hits.Docs, s.slice)
 }
 
 func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 
 	scroll, err := c.SourceESAPI.NextScroll(c.Config.ScrollTime, s.ScrollId)
 	if err != nil {
-		log.Error(err)
-		return false
+		//the request was already retried, give up on this scroll
+		s.stop(c, err)
+		return true
 	}
 
 	docs := scroll.GetDocs()
@@ -87,39 +214,43 @@ func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 		return true
 	}
 
+	scroll.SetSlice(s.slice)
 	scroll.ProcessScrollResult(c, bar)
 
 	//update scrollId
 	s.ScrollId = scroll.GetScrollId()
 
-	return
+	return s.slice != nil && s.slice.err != nil
 }
 
 // Stream from source es instance. "done" is an indicator that the stream is
 // over
 func (s *ScrollV7) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 
+	// a page missing shards is not delivered, the slice is read again from
+	// the previous page, unless --shard_failure=ignore
+	if err := s.shardFailure(); err != nil {
+		if c.Config.ShardFailure != ShardFailureIgnore {
+			s.stop(c, err)
+			return
+		}
+		log.Error(err)
+	}
+
 	//update progress bar
 	bar.Add(len(s.Hits.Docs))
 
-	// show any failures
-	for _, failure := range s.Shards.Failures {
-		reason, _ := json.Marshal(failure.Reason)
-		log.Errorf(string(reason))
-	}
-
 	// write all the docs into a channel
-	for _, doc := range s.Hits.Docs {
-		c.DocChan <- doc
-	}
+	c.sendDocs(s.Hits.Docs, s.slice)
 }
 
 func (s *ScrollV7) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 
 	scroll, err := c.SourceESAPI.NextScroll(c.Config.ScrollTime, s.ScrollId)
 	if err != nil {
-		log.Error(err)
-		return false
+		//the request was already retried, give up on this scroll
+		s.stop(c, err)
+		return true
 	}
 
 	docs := scroll.GetDocs()
@@ -128,12 +259,112 @@ func (s *ScrollV7) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 		return true
 	}
 
+	scroll.SetSlice(s.slice)
 	scroll.ProcessScrollResult(c, bar)
 
 	//update scrollId
 	s.ScrollId = scroll.GetScrollId()
 
-	return
+	return s.slice != nil && s.slice.err != nil
+}
+
+// stop ends the reading of the scroll with err, the owner of the slice may
+// open it again
+func (s *Scroll) stop(c *Migrator, err error) {
+	if s.slice == nil {
+		log.Errorf("scroll failed, stop reading it: %v", err)
+		c.setError(err)
+		return
+	}
+	s.slice.err = err
+}
+
+// shardFailure returns the failures of the shards which didn't answer the page
+func (s *Scroll) shardFailure() error {
+	if len(s.Shards.Failures) == 0 {
+		return nil
+	}
+	failure := &ShardFailureError{}
+	for _, f := range s.Shards.Failures {
+		reason, _ := json.Marshal(f.Reason)
+		failure.Failures = append(failure.Failures, fmt.Sprintf("[%s][%d] %s", f.Index, f.Shard, reason))
+	}
+	return failure
+}
+
+// sliceState follows one slice of a source index from page to page, and
+// across the scrolls opened again to recover it
+type sliceState struct {
+	checkpoint *SliceCheckpoint
+	lastSort   []interface{}       //sort values of the last delivered document
+	tied       []string            //ids delivered with the sort value of lastSort
+	skip       map[string]struct{} //ids of the sort value the slice was opened again from
+	delivered  int64
+	err        error //why the scroll stopped early
+}
+
+// reopen is called when the slice is read again from the sort value of
+// lastSort, the documents of that value already delivered are skipped
+func (slice *sliceState) reopen() {
+	slice.skip = make(map[string]struct{}, len(slice.tied))
+	for _, key := range slice.tied {
+		slice.skip[key] = struct{}{}
+	}
+}
+
+// skipTied drops the documents of the sort value the slice was opened again
+// from which were already delivered, and keeps the ids of the last sort value
+func (slice *sliceState) skipTied(docs []Document) []Document {
+	fresh := make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		if len(doc.Sort) == 0 {
+			fresh = append(fresh, doc)
+			continue
+		}
+		key := doc.Index + "/" + doc.Type + "/" + doc.Id
+		if len(slice.lastSort) > 0 && reflect.DeepEqual(doc.Sort[0], slice.lastSort[0]) {
+			if _, ok := slice.skip[key]; ok {
+				continue
+			}
+		} else {
+			//past the sort value opened again from, nothing left to skip
+			slice.skip = nil
+			slice.tied = slice.tied[:0]
+		}
+		slice.tied = append(slice.tied, key)
+		slice.lastSort = doc.Sort
+		fresh = append(fresh, doc)
+	}
+	return fresh
+}
+
+func (c *Migrator) sendDocs(docs []Document, slice *sliceState) {
+	var checkpoint *SliceCheckpoint
+	if slice != nil {
+		checkpoint = slice.checkpoint
+		docs = slice.skipTied(docs)
+		if len(docs) > 0 {
+			slice.lastSort = docs[len(docs)-1].Sort
+			slice.delivered += int64(len(docs))
+		}
+	}
+
+	if c.ScrollThrottle != nil {
+		size := 0
+		for _, doc := range docs {
+			size += len(doc.Source)
+		}
+		c.ScrollThrottle.Wait(len(docs), size, c.stop)
+	}
+	c.countRead(docs)
+	var batch *scrollBatch
+	if checkpoint != nil && len(docs) > 0 {
+		batch = checkpoint.NewBatch(docs)
+	}
+	for _, doc := range docs {
+		doc.checkpoint = batch
+		c.DocChan <- doc
+	}
 }
 
 // 返回空,从而在 compare + bulk 时有相同的处理逻辑
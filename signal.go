@@ -0,0 +1,58 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals stops the migration gracefully on the first SIGINT/SIGTERM:
+// the scrolls stop, the buffered documents are still bulk indexed, the
+// scroll contexts are deleted and the index settings are restored.
+// A second signal quits at once.
+func (m *Migrator) handleSignals() {
+	m.stop = make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Warnf("received %s, stopping the migration, send it again to quit immediately", sig)
+		close(m.stop)
+
+		sig = <-signals
+		log.Errorf("received %s again, quit", sig)
+		log.Flush()
+		os.Exit(ExitInterrupted)
+	}()
+}
+
+// Stopping tells whether the migration was asked to stop
+func (m *Migrator) Stopping() bool {
+	if m.stop == nil {
+		return false
+	}
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
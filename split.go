@@ -0,0 +1,122 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"sort"
+	"strings"
+)
+
+// defaultTypeName is the type of the target when the types of a source
+// index are merged or split into single type indices, unless -u is given
+const defaultTypeName = "_doc"
+
+func (m *Migrator) singleTypeName() string {
+	if len(m.Config.OverrideTypeName) > 0 {
+		return m.Config.OverrideTypeName
+	}
+	return defaultTypeName
+}
+
+// splitIndexName renders --split_types for a document of the source
+func (m *Migrator) splitIndexName(index string, typeName string) string {
+	name := strings.Replace(m.Config.SplitTypes, "{index}", index, -1)
+	name = strings.Replace(name, "{type}", typeName, -1)
+	return strings.ToLower(name)
+}
+
+// splitTypes replaces each source index in the mappings by one index per
+// type, holding the mapping of that type only. _default_ is not a type, and
+// _parent can't be kept once the parent and the child are apart
+func (m *Migrator) splitTypes(indexes *Indexes) error {
+	major, _ := versionOf(m.TargetESAPI)
+	m.splitSources = map[string]string{}
+
+	names := []string{}
+	for name := range *indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mappings, ok := (*indexes)[name].(map[string]interface{})["mappings"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(*indexes, name)
+		typeNames := []string{}
+		for typeName := range mappings {
+			if typeName != "_default_" {
+				typeNames = append(typeNames, typeName)
+			}
+		}
+		sort.Strings(typeNames)
+		typeOf := map[string]string{}
+		for _, typeName := range typeNames {
+			mapping := mappings[typeName]
+			target := m.splitIndexName(name, typeName)
+			if source, ok := m.splitSources[target]; ok {
+				if source == name {
+					source = fmt.Sprintf("type %s of %s", typeOf[target], source)
+				}
+				return fmt.Errorf("type %s of %s and %s are both split into %s", typeName, name, source, target)
+			}
+			m.splitSources[target] = name
+			typeOf[target] = typeName
+
+			if fields, ok := mapping.(map[string]interface{}); ok {
+				if parent, ok := fields["_parent"]; ok {
+					log.Warnf("type %s of %s is a child of %v, split apart from its parent it loses _parent, --join_field keeps the relation in one index",
+						typeName, name, parent)
+					delete(fields, "_parent")
+				}
+			}
+
+			//7.0 mappings have no type
+			if major >= 7 {
+				(*indexes)[target] = map[string]interface{}{"mappings": mapping}
+			} else {
+				(*indexes)[target] = map[string]interface{}{
+					"mappings": map[string]interface{}{m.singleTypeName(): mapping},
+				}
+			}
+			log.Infof("type %s of %s is split into %s", typeName, name, target)
+		}
+	}
+	return nil
+}
+
+// splitIndexSettings gives each index split from a source index its own copy
+// of the settings of the source
+func (m *Migrator) splitIndexSettings(settings *Indexes) {
+	for target, source := range m.splitSources {
+		data, err := json.Marshal((*settings)[source])
+		if err != nil {
+			continue
+		}
+		copied := map[string]interface{}{}
+		if json.Unmarshal(data, &copied) == nil {
+			(*settings)[target] = copied
+		}
+	}
+	for _, source := range m.splitSources {
+		delete(*settings, source)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSplitTypes(t *testing.T) {
+	cases := []struct {
+		name     string
+		target   string //version of the target
+		mappings string
+		want     string
+		err      bool
+	}{
+		{name: "one index per type", target: "6.8.0",
+			mappings: `{"blog":{"mappings":{"post":{"properties":{"title":{"type":"text"}}},"user":{"properties":{"name":{"type":"keyword"}}}}}}`,
+			want:     `{"blog-post":{"mappings":{"_doc":{"properties":{"title":{"type":"text"}}}}},"blog-user":{"mappings":{"_doc":{"properties":{"name":{"type":"keyword"}}}}}}`},
+		{name: "typeless target", target: "7.10.2",
+			mappings: `{"blog":{"mappings":{"post":{"properties":{"title":{"type":"text"}}}}}}`,
+			want:     `{"blog-post":{"mappings":{"properties":{"title":{"type":"text"}}}}}`},
+		{name: "_default_ is not a type", target: "7.10.2",
+			mappings: `{"blog":{"mappings":{"_default_":{"_all":{"enabled":false}},"post":{"properties":{}}}}}`,
+			want:     `{"blog-post":{"mappings":{"properties":{}}}}`},
+		{name: "_parent is dropped", target: "7.10.2",
+			mappings: `{"blog":{"mappings":{"post":{"properties":{}},"comment":{"_parent":{"type":"post"},"_routing":{"required":true},"properties":{}}}}}`,
+			want:     `{"blog-comment":{"mappings":{"_routing":{"required":true},"properties":{}}},"blog-post":{"mappings":{"properties":{}}}}`},
+		{name: "names are lowercase", target: "7.10.2",
+			mappings: `{"blog":{"mappings":{"Post":{"properties":{}}}}}`,
+			want:     `{"blog-post":{"mappings":{"properties":{}}}}`},
+		{name: "types of an index split into the same index", target: "7.10.2",
+			mappings: `{"blog":{"mappings":{"Post":{"properties":{}},"post":{"properties":{}}}}}`,
+			err:      true},
+		{name: "types of two indices split into the same index", target: "7.10.2",
+			mappings: `{"a-b":{"mappings":{"c":{"properties":{}}}},"a":{"mappings":{"b-c":{"properties":{}}}}}`,
+			err:      true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			indexes := &Indexes{}
+			if err := json.Unmarshal([]byte(c.mappings), indexes); err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &Config{SplitTypes: "{index}-{type}"}, TargetESAPI: versionAPI(c.target)}
+			err := m.splitTypes(indexes)
+			if c.err {
+				if err == nil {
+					t.Error("split should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(indexes)
+			if string(got) != c.want {
+				t.Errorf("split into %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSplitIndexSettings(t *testing.T) {
+	m := &Migrator{Config: &Config{SplitTypes: "{index}_{type}"}, TargetESAPI: versionAPI("7.10.2")}
+	mappings := &Indexes{}
+	if err := json.Unmarshal([]byte(`{"blog":{"mappings":{"post":{},"user":{}}},"logs":{"mappings":{"doc":{}}}}`), mappings); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.splitTypes(mappings); err != nil {
+		t.Fatal(err)
+	}
+	settings := &Indexes{}
+	if err := json.Unmarshal([]byte(`{"blog":{"settings":{"index":{"number_of_shards":"2"}}},"logs":{"settings":{"index":{"number_of_shards":"1"}}}}`), settings); err != nil {
+		t.Fatal(err)
+	}
+	m.splitIndexSettings(settings)
+	got, _ := json.Marshal(settings)
+	want := `{"blog_post":{"settings":{"index":{"number_of_shards":"2"}}},"blog_user":{"settings":{"index":{"number_of_shards":"2"}}},"logs_doc":{"settings":{"index":{"number_of_shards":"1"}}}}`
+	if string(got) != want {
+		t.Errorf("settings %s, want %s", got, want)
+	}
+
+	//each split index has a copy of its own
+	(*settings)["blog_post"].(map[string]interface{})["settings"] = nil
+	if (*settings)["blog_user"].(map[string]interface{})["settings"] == nil {
+		t.Error("the split indices share their settings")
+	}
+}
@@ -0,0 +1,483 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// syncPair is one source index synced to its target, with the counts of
+// the documents added, updated and deleted
+type syncPair struct {
+	source  string
+	target  string
+	showBar bool
+	added   int
+	updated int
+	deleted int
+	skipped bool
+	err     error
+}
+
+// planSync pairs each source index matching -x with its target: the same
+// name, -y when only one index matches, or -y as a template with {index}
+func (m *Migrator) planSync() ([]*syncPair, error) {
+	pattern := m.Config.SourceIndexNames
+	names, err := m.sourceIndices(pattern)
+	if err != nil {
+		if strings.ContainsAny(pattern, "*?,") || pattern == "_all" {
+			return nil, fmt.Errorf("can not list the source indices matching %s: %v", pattern, err)
+		}
+		//before 5.0 _cat has no json, sync the name as given
+		log.Warnf("can not list the source indices, sync %s as one index: %v", pattern, err)
+		names = []string{pattern}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no source index matches %s", pattern)
+	}
+
+	target := m.Config.TargetIndexName
+	template := strings.Contains(target, "{index}")
+	if len(names) > 1 && len(target) > 0 && !template {
+		return nil, fmt.Errorf("%d indices match %s, they can not all be synced to %s, use {index} in -y to name each target",
+			len(names), pattern, target)
+	}
+
+	pairs := []*syncPair{}
+	targets := map[string]string{}
+	for _, name := range names {
+		pair := &syncPair{source: name, target: name, showBar: len(names) == 1}
+		if template {
+			pair.target = strings.Replace(target, "{index}", name, -1)
+		} else if len(target) > 0 {
+			pair.target = target
+		}
+		if other, ok := targets[pair.target]; ok {
+			return nil, fmt.Errorf("%s and %s would both be synced to %s", other, name, pair.target)
+		}
+		if m.Config.SourceEs == m.Config.TargetEs && pair.source == pair.target {
+			return nil, fmt.Errorf("can not sync %s to itself", name)
+		}
+		targets[pair.target] = name
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// syncIndices diffs and syncs the pairs, workers of them at once, and logs
+// the counts of each of them. The pairs still queued when the run stops are
+// skipped. The error of the first failed pair is returned
+func (m *Migrator) syncIndices(pairs []*syncPair, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(pairs) {
+		workers = len(pairs)
+	}
+
+	queue := make(chan *syncPair, len(pairs))
+	for _, pair := range pairs {
+		queue <- pair
+	}
+	close(queue)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range queue {
+				if m.Stopping() {
+					pair.skipped = true
+					continue
+				}
+				log.Infof("sync %s to %s", pair.source, pair.target)
+				pair.err = m.SyncBetweenIndex(m.SourceESAPI, m.TargetESAPI, m.Config, pair)
+				if pair.err != nil {
+					log.Errorf("failed to sync %s to %s: %v", pair.source, pair.target, pair.err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var err error
+	added, updated, deleted, failed, skipped := 0, 0, 0, 0, 0
+	for _, pair := range pairs {
+		if pair.skipped {
+			skipped++
+			log.Warnf("%s => %s: skipped, the run stopped before it", pair.source, pair.target)
+			continue
+		}
+		if pair.err != nil {
+			failed++
+			if err == nil {
+				err = pair.err
+			}
+			continue
+		}
+		added += pair.added
+		updated += pair.updated
+		deleted += pair.deleted
+		if len(pairs) > 1 {
+			log.Infof("%s => %s: add=%d, update=%d, delete=%d", pair.source, pair.target,
+				pair.added, pair.updated, pair.deleted)
+		}
+	}
+	if len(pairs) > 1 {
+		log.Infof("synced %d indices, add=%d, update=%d, delete=%d, %d indices failed, %d indices skipped",
+			len(pairs)-failed-skipped, added, updated, deleted, failed, skipped)
+	}
+	return err
+}
+
+// scrollRuns reads the whole index, unsorted, into the runs of the bucket
+// of each id, in sliced scrolls read at the same time since 5.0.
+// With --compare_mode=script, only the digests of the documents are read
+func (m *Migrator) scrollRuns(api ESAPI, index string, runs *runBuckets, bar *pb.ProgressBar) (int, error) {
+	opts := []ScrollOption{}
+	if m.Config.CompareMode == CompareScript {
+		opts = append(opts, m.digestOption())
+	}
+	slices := len(runs.writers)
+	if major, _ := versionOf(api); major < 5 {
+		slices = 1
+	}
+	if bar != nil {
+		atomic.StoreInt64(&bar.Total, 0)
+	}
+
+	totals := make([]int, slices)
+	errs := make([]error, slices)
+	wg := sync.WaitGroup{}
+	for slice := 0; slice < slices; slice++ {
+		wg.Add(1)
+		go func(slice int) {
+			defer wg.Done()
+			totals[slice], errs[slice] = m.scrollPages(api, index, slice, slices, bar, func(docs []Document) error {
+				for i := range docs {
+					doc := &docs[i]
+					hash, err := m.entryHash(doc)
+					if err != nil {
+						return err
+					}
+					entry := runEntry{index: doc.Index, id: doc.Id, typ: doc.Type, routing: doc.routing(), hash: hash}
+					if err = runs.add(entry); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, opts...)
+		}(slice)
+	}
+	wg.Wait()
+
+	total := 0
+	for slice := range totals {
+		if errs[slice] != nil {
+			return total, errs[slice]
+		}
+		total += totals[slice]
+	}
+	return total, nil
+}
+
+// scrollPages hands the pages of a slice of a scroll of index to fn, and returns the
+// total of hits. A page with failed shards can not be trusted to tell the
+// missing documents, the scroll fails unless --shard_failure=ignore
+func (m *Migrator) scrollPages(api ESAPI, index string, slice int, slices int, bar *pb.ProgressBar,
+	fn func(docs []Document) error, opts ...ScrollOption) (int, error) {
+
+	cfg := m.Config
+	scroll, err := api.NewScroll(index, cfg.ScrollTime, cfg.DocBufferCount, cfg.Query, "", slice, slices, cfg.Fields,
+		m.scrollOptions(opts...)...)
+	if err != nil {
+		return 0, err
+	}
+	total := scroll.GetHitsTotal()
+	if bar != nil {
+		atomic.AddInt64(&bar.Total, int64(total))
+	}
+	defer func() {
+		api.DeleteScroll(scroll.GetScrollId())
+	}()
+
+	//the first page of a scan is empty
+	first := true
+	for !m.Stopping() {
+		if failed, ok := scroll.(interface{ shardFailure() error }); ok {
+			if err = failed.shardFailure(); err != nil {
+				if cfg.ShardFailure != ShardFailureIgnore {
+					return total, err
+				}
+				log.Error(err)
+			}
+		}
+		docs := scroll.GetDocs()
+		if len(docs) == 0 && !first {
+			break
+		}
+		first = false
+		if err = fn(docs); err != nil {
+			return total, err
+		}
+		if bar != nil {
+			bar.Add(len(docs))
+		}
+
+		next, err := api.NextScroll(cfg.ScrollTime, scroll.GetScrollId())
+		if err != nil {
+			return total, err
+		}
+		scroll = next
+	}
+	return total, nil
+}
+
+// syncChanges gathers the changes of a pair in batches: the sources of the
+// added and updated documents are fetched by _mget, filtered by --fields
+// like the scroll compared them, and indexed, the deleted
+// ones are deleted when --enable_delete is set. Every change goes to the
+// diff report, if any
+type syncChanges struct {
+	m         *Migrator
+	src       ESAPI
+	dst       ESAPI
+	pair      *syncPair
+	batchSize int
+	srcMajor  int
+	dstMajor  int
+	added     []Document
+	updated   []Document
+	targets   []Document //target documents of the updates
+	deleted   []Document
+	adds      int
+	updates   int
+	deletes   int
+}
+
+func newSyncChanges(m *Migrator, src ESAPI, dst ESAPI, pair *syncPair) *syncChanges {
+	changes := &syncChanges{m: m, src: src, dst: dst, pair: pair, batchSize: m.Config.DocBufferCount}
+	if changes.batchSize < 1 {
+		changes.batchSize = 1
+	}
+	changes.srcMajor, _ = versionOf(src)
+	changes.dstMajor, _ = versionOf(dst)
+	return changes
+}
+
+// ref is what _mget needs to find the document again, it takes routing
+// without underscore since 6.0
+func ref(e *runEntry, major int) Document {
+	doc := Document{Index: e.index, Type: e.typ, Id: e.id}
+	if major < 6 {
+		doc.HitRouting = e.routing
+	} else {
+		doc.Routing = e.routing
+	}
+	return doc
+}
+
+// joinType is the type an entry is joined on: the type a source document is
+// written with, and the type of a target document, none since 7.0
+func (c *syncChanges) joinType(e *runEntry, source bool) string {
+	if source {
+		return c.m.targetType(e.typ)
+	}
+	if c.dstMajor >= 7 {
+		return ""
+	}
+	return e.typ
+}
+
+func (c *syncChanges) add(e *runEntry) error {
+	c.adds++
+	c.added = append(c.added, ref(e, c.srcMajor))
+	return c.flushWrites(false)
+}
+
+func (c *syncChanges) update(srcEntry *runEntry, dstEntry *runEntry) error {
+	c.updates++
+	c.updated = append(c.updated, ref(srcEntry, c.srcMajor))
+	c.targets = append(c.targets, ref(dstEntry, c.dstMajor))
+	return c.flushWrites(false)
+}
+
+func (c *syncChanges) delete(e *runEntry) error {
+	c.deletes++
+	c.deleted = append(c.deleted, ref(e, c.dstMajor))
+	return c.flushDeletes(false)
+}
+
+func (c *syncChanges) flush() error {
+	if err := c.flushWrites(true); err != nil {
+		return err
+	}
+	return c.flushDeletes(true)
+}
+
+func (c *syncChanges) flushWrites(force bool) error {
+	size := len(c.added) + len(c.updated)
+	if size == 0 || size < c.batchSize && !force {
+		return nil
+	}
+	defer func() {
+		c.added = c.added[:0]
+		c.updated = c.updated[:0]
+		c.targets = c.targets[:0]
+	}()
+
+	report := c.m.DiffReport
+	fields := report != nil && report.Fields && len(c.updated) > 0
+	var docs []Document
+	var err error
+	if !c.m.Config.Dry {
+		docs, err = c.src.MultiGet("", append(c.added, c.updated...), c.m.Config.Fields)
+	} else if fields {
+		docs, err = c.src.MultiGet("", c.updated, c.m.Config.Fields)
+	}
+	if err != nil {
+		return fmt.Errorf("can not get the changed documents of %s, reason: %w", c.pair.source, err)
+	}
+
+	if report != nil {
+		changes := c.report(changeAdded, c.added)
+		updates := c.report(changeUpdated, c.updated)
+		if fields {
+			targets, err := c.dst.MultiGet("", c.targets, c.m.Config.Fields)
+			if err != nil {
+				return fmt.Errorf("can not get the changed documents of %s, reason: %w", c.pair.target, err)
+			}
+			srcDocs, dstDocs := docsByKey(docs), docsByKey(targets)
+			for i := range updates {
+				updates[i].Fields = c.diffFields(srcDocs[docKey(&c.updated[i])], dstDocs[docKey(&c.targets[i])])
+			}
+		}
+		report.Write(append(changes, updates...))
+	}
+
+	if c.m.Config.Dry {
+		if report == nil {
+			showDocs("new", refIds(c.added))
+			showDocs("diff", refIds(c.updated))
+		}
+		return nil
+	}
+	writes := make([]Document, 0, len(docs))
+	for i := range docs {
+		doc := &docs[i]
+		writes = append(writes, Document{Id: doc.Id, Type: c.m.targetType(doc.Type), Routing: doc.routing(), Source: doc.Source})
+	}
+	log.Debugf("now will bulk index %d records", len(writes))
+	return c.m.bulkRecords(opIndex, c.dst, c.pair.target, writes)
+}
+
+func (c *syncChanges) flushDeletes(force bool) error {
+	if len(c.deleted) == 0 || len(c.deleted) < c.batchSize && !force {
+		return nil
+	}
+	defer func() {
+		c.deleted = c.deleted[:0]
+	}()
+
+	c.m.DiffReport.Write(c.report(changeDeleted, c.deleted))
+	if c.m.Config.Dry {
+		if c.m.DiffReport == nil {
+			showDocs("delete", refIds(c.deleted))
+		}
+		return nil
+	}
+	if !c.m.Config.EnableDelete {
+		return nil
+	}
+	deletes := make([]Document, 0, len(c.deleted))
+	for i := range c.deleted {
+		doc := &c.deleted[i]
+		//the type of the document in the target, typeless since 7.0
+		typ := doc.Type
+		if c.dstMajor >= 7 {
+			typ = ""
+		}
+		deletes = append(deletes, Document{Id: doc.Id, Type: typ, Routing: doc.routing()})
+	}
+	log.Debugf("now will bulk delete %d records", len(deletes))
+	return c.m.bulkRecords(opDelete, c.dst, c.pair.target, deletes)
+}
+
+func (c *syncChanges) report(change string, docs []Document) []DiffChange {
+	changes := make([]DiffChange, 0, len(docs))
+	for _, doc := range docs {
+		changes = append(changes, DiffChange{Index: c.pair.source, Target: c.pair.target, Type: doc.Type,
+			Id: doc.Id, Change: change})
+	}
+	return changes
+}
+
+// diffFields compares an updated document on both sides, the document is
+// whole when one side is missing
+func (c *syncChanges) diffFields(src json.RawMessage, dst json.RawMessage) []string {
+	if src == nil || dst == nil {
+		return nil
+	}
+	srcDoc, err := c.m.canonicalDoc(src)
+	if err != nil {
+		return nil
+	}
+	dstDoc, err := c.m.canonicalDoc(dst)
+	if err != nil {
+		return nil
+	}
+	return diffFields(srcDoc, dstDoc, "")
+}
+
+// targetType is the type a document of type typ is written with: -u if set,
+// and none on targets since 7.0
+func (m *Migrator) targetType(typ string) string {
+	if major, _ := versionOf(m.TargetESAPI); major >= 7 {
+		return ""
+	}
+	if len(m.Config.OverrideTypeName) > 0 {
+		return m.Config.OverrideTypeName
+	}
+	return typ
+}
+
+func docKey(doc *Document) string {
+	return doc.Index + "/" + doc.Type + "/" + doc.Id
+}
+
+func docsByKey(docs []Document) map[string]json.RawMessage {
+	sources := make(map[string]json.RawMessage, len(docs))
+	for i := range docs {
+		sources[docKey(&docs[i])] = docs[i].Source
+	}
+	return sources
+}
+
+func refIds(docs []Document) map[string]json.RawMessage {
+	ids := make(map[string]json.RawMessage, len(docs))
+	for _, doc := range docs {
+		ids[doc.Id] = nil
+	}
+	return ids
+}
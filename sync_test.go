@@ -0,0 +1,66 @@
+/*
+Copyright Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlanSyncListingFailed(t *testing.T) {
+	source := &indexSource{err: errors.New("no _cat json")}
+	cases := []struct {
+		pattern string
+		fails   bool
+	}{
+		{"logs", false},
+		{"logs-*", true},
+		{"logs-?", true},
+		{"logs,metrics", true},
+		{"_all", true},
+	}
+	for _, c := range cases {
+		m := &Migrator{Config: &Config{SourceIndexNames: c.pattern, TargetIndexName: "copy"}, SourceESAPI: source}
+		pairs, err := m.planSync()
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: planned %d pairs, want an error", c.pattern, len(pairs))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.pattern, err)
+		}
+		if len(pairs) != 1 || pairs[0].source != c.pattern || pairs[0].target != "copy" {
+			t.Errorf("%s: got %+v, want %s to copy", c.pattern, pairs[0], c.pattern)
+		}
+	}
+}
+
+func TestSyncIndicesStopped(t *testing.T) {
+	m := &Migrator{Config: &Config{}, stop: make(chan struct{})}
+	close(m.stop)
+	pairs := []*syncPair{{source: "a", target: "a"}, {source: "b", target: "b"}}
+	if err := m.syncIndices(pairs, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if !pair.skipped || pair.err != nil {
+			t.Errorf("%s: skipped=%v, err=%v, want it skipped", pair.source, pair.skipped, pair.err)
+		}
+	}
+}
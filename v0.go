@@ -19,7 +19,6 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"io"
@@ -27,6 +26,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ESAPIV0 struct {
@@ -35,6 +35,9 @@ type ESAPIV0 struct {
 	HttpProxy string //eg: http://proxyIp:proxyPort
 	Compress  bool
 	Version   *ClusterVersion
+
+	//BulkRetryThrottle holds the items a bulk sends again to the rate limits
+	BulkRetryThrottle func(docs int, size int)
 }
 
 func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
@@ -64,35 +67,147 @@ func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
 	return health
 }
 
+func (s *ESAPIV0) WaitForIndexHealth(indexNames string, status string, timeout string) (*ClusterHealth, error) {
+
+	url := fmt.Sprintf("%s/_cluster/health/%s?wait_for_status=%s&timeout=%s", s.Host, indexNames, status, timeout)
+	r, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if r != nil && r.Body != nil {
+		io.Copy(ioutil.Discard, r.Body)
+		defer r.Body.Close()
+	}
+
+	if errs != nil {
+		return nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
+	}
+
+	//a timed out wait answers 408 with the current health
+	if r.StatusCode != 200 && r.StatusCode != 408 {
+		return nil, newHTTPStatusError("GET", url, r.StatusCode, []byte(body))
+	}
+
+	health := &ClusterHealth{}
+	err := json.Unmarshal([]byte(body), health)
+	if err != nil {
+		return nil, &DecodeError{Body: body, Err: err}
+	}
+	return health, nil
+}
+
+func (s *ESAPIV0) NodesThreadPoolStats() (*NodesStats, error) {
+
+	url := fmt.Sprintf("%s/_nodes/stats/thread_pool", s.Host)
+	r, body, errs := Get(url, s.Auth, s.HttpProxy)
+
+	if r != nil && r.Body != nil {
+		io.Copy(ioutil.Discard, r.Body)
+		defer r.Body.Close()
+	}
+
+	if errs != nil {
+		return nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
+	}
+
+	if r.StatusCode != 200 {
+		return nil, newHTTPStatusError("GET", url, r.StatusCode, []byte(body))
+	}
+
+	stats := &NodesStats{}
+	err := json.Unmarshal([]byte(body), stats)
+	if err != nil {
+		return nil, &DecodeError{Body: body, Err: err}
+	}
+	return stats, nil
+}
+
 func (s *ESAPIV0) ClusterVersion() *ClusterVersion {
 	return s.Version
 }
 
-func (s *ESAPIV0) Bulk(data *bytes.Buffer) error {
+func (s *ESAPIV0) Bulk(data *bytes.Buffer) (*BulkResult, error) {
+	result := &BulkResult{}
 	if data == nil || data.Len() == 0 {
 		log.Trace("data is empty, skip")
-		return nil
+		return result, nil
+	}
+	defer data.Reset()
+	if data.Bytes()[data.Len()-1] != '\n' {
+		data.WriteRune('\n')
 	}
-	data.WriteRune('\n')
 	url := fmt.Sprintf("%s/_bulk", s.Host)
 
-	body, err := Request(s.Compress, "POST", url, s.Auth, data, s.HttpProxy)
-
-	if err != nil {
-		data.Reset()
-		log.Error(err)
-		return err
+	payload := data.Bytes()
+	//a bulk with generated ids indexes them again if sent twice
+	send := Request
+	if !idempotentBulk(payload) {
+		send = RequestNoReplay
 	}
-	response := BulkResponse{}
-	err = DecodeJson(body, &response)
-	if err == nil {
-		if response.Errors {
-			log.Warnf("bulk error:%s", body)
+	for attempt := 0; ; attempt++ {
+		body, err := send(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(payload), s.HttpProxy)
+		if err != nil {
+			log.Error(err)
+			//the whole request was lost, none of the items made it
+			failBulkItems(result, payload, "request_error", err)
+			return result, err
 		}
-	}
 
-	data.Reset()
-	return err
+		response := BulkResponse{}
+		err = DecodeJson(body, &response)
+		if err != nil {
+			//what made it is unknown, count all of them as failed
+			failBulkItems(result, payload, "decode_error", err)
+			return result, err
+		}
+
+		items, err := parseBulkItems(payload)
+		if err == nil && len(items) != len(response.Items) {
+			err = fmt.Errorf("bulk response has %d items for %d documents", len(response.Items), len(items))
+		}
+		if err != nil {
+			log.Warnf("bulk error, can't match the response items with the request:%s", body)
+			failBulkItems(result, payload, "response_mismatch", err)
+			return result, err
+		}
+		if !response.Errors {
+			result.Succeeded += len(response.Items)
+			return result, nil
+		}
+
+		retry := bytes.Buffer{}
+		retryCount := 0
+		for i, item := range response.Items {
+			for _, action := range item {
+				if action.Error == nil && action.Status < 300 {
+					result.Succeeded++
+					continue
+				}
+				if isRetriableBulkItem(&action) && attempt+1 < retryPolicy.MaxAttempts {
+					items[i].writeTo(&retry)
+					retryCount++
+					continue
+				}
+				log.Debugf("bulk item failed, index:%s, id:%s, status:%d, error:%s",
+					action.Index, action.Id, action.Status, action.ErrorReason())
+				result.Failed = append(result.Failed, items[i].failure(action.Status, action.ErrorType(), action.ErrorReason()))
+			}
+		}
+
+		if len(result.Failed) > 0 && retryCount == 0 {
+			log.Warnf("bulk error, %d documents failed", len(result.Failed))
+		}
+		if retryCount == 0 {
+			return result, nil
+		}
+
+		backoff := retryPolicy.Backoff(attempt)
+		log.Debugf("bulk rejected %d documents, retry after %s", retryCount, backoff)
+		result.Retried += retryCount
+		time.Sleep(backoff)
+		payload = retry.Bytes()
+		if s.BulkRetryThrottle != nil {
+			s.BulkRetryThrottle(retryCount, len(payload))
+		}
+	}
 }
 
 func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
@@ -109,19 +224,18 @@ func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
 	}
 
 	if errs != nil {
-		return nil, errs[0]
+		return nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, errors.New(body)
+		return nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
 	}
 
 	log.Debug(body)
 
 	err := json.Unmarshal([]byte(body), allSettings)
 	if err != nil {
-		panic(err)
-		return nil, err
+		return nil, &DecodeError{Body: body, Err: err}
 	}
 
 	return allSettings, nil
@@ -138,11 +252,11 @@ func (s *ESAPIV0) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 
 	if errs != nil {
 		log.Error(errs)
-		return "", 0, nil, errs[0]
+		return "", 0, nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 
 	if resp.StatusCode != 200 {
-		return "", 0, nil, errors.New(body)
+		return "", 0, nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
 	}
 
 	idxs := Indexes{}
@@ -241,7 +355,8 @@ func (s *ESAPIV0) UpdateIndexSettings(name string, settings map[string]interface
 			bodyStr, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.HttpProxy)
 			if err != nil {
 				log.Error(bodyStr, err)
-				panic(err)
+				//don't leave the index closed
+				Request(false, "POST", fmt.Sprintf("%s/%s/_open", s.Host, name), s.Auth, nil, s.HttpProxy)
 				return err
 			}
 			delete(settings["settings"].(map[string]interface{})["index"].(map[string]interface{}), "analysis")
@@ -278,12 +393,134 @@ func (s *ESAPIV0) UpdateIndexMapping(indexName string, settings map[string]inter
 			log.Error(url)
 			log.Error(body.String())
 			log.Error(err, res)
-			panic(err)
+			return err
 		}
 	}
 	return nil
 }
 
+func (s *ESAPIV0) ValidateQuery(indexNames string, query map[string]interface{}) error {
+	url := fmt.Sprintf("%s/%s/_validate/query?explain=true", s.Host, indexNames)
+	jsonBody, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return err
+	}
+
+	body, err := Request(false, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Valid        bool   `json:"valid"`
+		Error        string `json:"error,omitempty"`
+		Explanations []struct {
+			Index string `json:"index,omitempty"`
+			Valid bool   `json:"valid"`
+			Error string `json:"error,omitempty"`
+		} `json:"explanations,omitempty"`
+	}{}
+	err = DecodeJson(body, &result)
+	if err != nil {
+		return err
+	}
+	if result.Valid {
+		return nil
+	}
+
+	reasons := []string{}
+	if len(result.Error) > 0 {
+		reasons = append(reasons, result.Error)
+	}
+	for _, explanation := range result.Explanations {
+		if !explanation.Valid && len(explanation.Error) > 0 {
+			reasons = append(reasons, fmt.Sprintf("[%s] %s", explanation.Index, explanation.Error))
+		}
+	}
+	return fmt.Errorf("invalid query: %s", strings.Join(reasons, ", "))
+}
+
+// MultiGet fetches the documents by their id, type and routing, the ones
+// not found are left out. Without indexName, the docs name their index.
+// fields filters the source like the fields of a scroll, comma separated
+func (s *ESAPIV0) MultiGet(indexName string, docs []Document, fields string) ([]Document, error) {
+	url := fmt.Sprintf("%s/_mget", s.Host)
+	if len(indexName) > 0 {
+		url = fmt.Sprintf("%s/%s/_mget", s.Host, indexName)
+	}
+	if len(fields) > 0 {
+		url = fmt.Sprintf("%s?_source=%s", url, fields)
+	}
+	jsonBody, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Docs []struct {
+			Document
+			Found bool `json:"found"`
+		} `json:"docs"`
+	}{}
+	err = DecodeJson(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]Document, 0, len(result.Docs))
+	for _, doc := range result.Docs {
+		if doc.Found {
+			found = append(found, doc.Document)
+		}
+	}
+	return found, nil
+}
+
+// FieldRange returns the min and max of field, in epoch millis for a date,
+// only the aggregations of a date have a value_as_string
+func (s *ESAPIV0) FieldRange(indexNames string, field string) (min *float64, max *float64, date bool, err error) {
+	url := fmt.Sprintf("%s/%s/_search", s.Host, indexNames)
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"min": map[string]interface{}{"min": map[string]interface{}{"field": field}},
+			"max": map[string]interface{}{"max": map[string]interface{}{"field": field}},
+		},
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	body, err := Request(false, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	//value is null when no document has the field
+	result := struct {
+		Aggregations struct {
+			Min struct {
+				Value         *float64 `json:"value"`
+				ValueAsString string   `json:"value_as_string"`
+			} `json:"min"`
+			Max struct {
+				Value *float64 `json:"value"`
+			} `json:"max"`
+		} `json:"aggregations"`
+	}{}
+	err = DecodeJson(body, &result)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	date = len(result.Aggregations.Min.ValueAsString) > 0
+	return result.Aggregations.Min.Value, result.Aggregations.Max.Value, date, nil
+}
+
 func (s *ESAPIV0) DeleteIndex(name string) (err error) {
 
 	log.Debug("start delete index: ", name)
@@ -331,33 +568,15 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 }
 
 func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (scroll ScrollAPI, err error) {
 
 	// curl -XGET 'http://es-0.9:9200/_search?search_type=scan&scroll=10m&size=50'
 	url := fmt.Sprintf("%s/%s/_search?search_type=scan&scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
 	var jsonBody []byte
-	if len(query) > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
+	if len(query) > 0 || len(fields) > 0 || len(opts) > 0 {
+		//sliced scroll is not supported before 5.0
+		queryBody := newScrollBody(query, sort, 0, 0, fields, opts)
 
 		jsonBody, err = json.Marshal(queryBody)
 		if err != nil {
@@ -387,7 +606,7 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	//  curl -XGET 'http://es-0.9:9200/_search/scroll?scroll=5m'
 	id := bytes.NewBufferString(scrollId)
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := RequestNoReplay(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
 
 	if err != nil {
 		log.Error(err)
@@ -487,10 +706,10 @@ func (c *ESAPIV0) GetIndices(pattern string) (*map[string]IndexInfo, error) {
 		defer resp.Body.Close()
 	}
 	if errs != nil {
-		return nil, errs[0]
+		return nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(body)
+		return nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
 	}
 	data := []CatIndexResponse{}
 	err := json.Unmarshal([]byte(body), &data)
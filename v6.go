@@ -19,7 +19,6 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"io"
@@ -34,44 +33,16 @@ type ESAPIV6 struct {
 }
 
 func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (scroll ScrollAPI, err error) {
 	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
 	var jsonBody []byte
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
-
-		if maxSlicedCount > 1 {
-			log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
-			queryBody["slice"] = map[string]interface{}{}
-			queryBody["slice"].(map[string]interface{})["id"] = slicedId
-			queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
-		}
+	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 || len(opts) > 0 {
+		queryBody := newScrollBody(query, sort, slicedId, maxSlicedCount, fields, opts)
 
 		jsonBody, err = json.Marshal(queryBody)
 		if err != nil {
 			log.Error(err)
-
 		}
 	}
 
@@ -95,7 +66,7 @@ func (s *ESAPIV6) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	id := bytes.NewBufferString(scrollId)
 
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := RequestNoReplay(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
 
 	// decode elasticsearch scroll response
 	scroll := &Scroll{}
@@ -119,11 +90,11 @@ func (s *ESAPIV6) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 
 	if errs != nil {
 		log.Error(errs)
-		return "", 0, nil, errs[0]
+		return "", 0, nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 
 	if resp.StatusCode != 200 {
-		return "", 0, nil, errors.New(body)
+		return "", 0, nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
 	}
 
 	idxs := Indexes{}
@@ -194,7 +165,7 @@ func (s *ESAPIV6) UpdateIndexMapping(indexName string, settings map[string]inter
 			log.Error(url)
 			log.Error(settings)
 			log.Error(err, res)
-			panic(err)
+			return err
 		}
 	}
 	return nil
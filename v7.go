@@ -19,7 +19,6 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"io"
@@ -33,39 +32,12 @@ type ESAPIV7 struct {
 }
 
 func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	slicedId int, maxSlicedCount int, fields string, opts ...ScrollOption) (scroll ScrollAPI, err error) {
 	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
 
 	jsonBody := ""
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
-
-		if maxSlicedCount > 1 {
-			log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
-			queryBody["slice"] = map[string]interface{}{}
-			queryBody["slice"].(map[string]interface{})["id"] = slicedId
-			queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
-		}
+	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 || len(opts) > 0 {
+		queryBody := newScrollBody(query, sort, slicedId, maxSlicedCount, fields, opts)
 
 		jsonArray, err := json.Marshal(queryBody)
 		if err != nil {
@@ -114,7 +86,7 @@ func (s *ESAPIV7) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	id := bytes.NewBufferString(scrollId)
 
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := RequestNoReplay(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
 
 	if err != nil {
 		//log.Error(errs)
@@ -131,6 +103,53 @@ func (s *ESAPIV7) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	return scroll, nil
 }
 
+func (s *ESAPIV7) OpenPointInTime(indexNames string, keepAlive string) (string, error) {
+	url := fmt.Sprintf("%s/%s/_pit?keep_alive=%s", s.Host, indexNames, keepAlive)
+	body, err := Request(false, "POST", url, s.Auth, nil, s.HttpProxy)
+	if err != nil {
+		return "", err
+	}
+
+	pit := struct {
+		Id string `json:"id"`
+	}{}
+	err = DecodeJson(body, &pit)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("opened point in time on %s", indexNames)
+	return pit.Id, nil
+}
+
+func (s *ESAPIV7) SearchPointInTime(queryBody map[string]interface{}) (*PitScroll, error) {
+	//the point in time already knows the indices
+	url := fmt.Sprintf("%s/_search", s.Host)
+	jsonBody, err := json.Marshal(queryBody)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	scroll := &PitScroll{}
+	err = DecodeJson(body, scroll)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scroll, nil
+}
+
+func (s *ESAPIV7) ClosePointInTime(id string) error {
+	url := fmt.Sprintf("%s/_pit", s.Host)
+	jsonBody, _ := json.Marshal(map[string]string{"id": id})
+	_, err := Request(false, "DELETE", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	return err
+}
+
 func (s *ESAPIV7) GetIndexMappings(copyAllIndexes bool, indexNames string) (string, int, *Indexes, error) {
 	url := fmt.Sprintf("%s/%s/_mapping", s.Host, indexNames)
 	resp, body, errs := Get(url, s.Auth, s.HttpProxy)
@@ -142,11 +161,11 @@ func (s *ESAPIV7) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 
 	if errs != nil {
 		log.Error(errs)
-		return "", 0, nil, errs[0]
+		return "", 0, nil, &TransportError{Method: "GET", Url: url, Err: errs[0]}
 	}
 
 	if resp.StatusCode != 200 {
-		return "", 0, nil, errors.New(body)
+		return "", 0, nil, newHTTPStatusError("GET", url, resp.StatusCode, []byte(body))
 	}
 
 	idxs := Indexes{}
@@ -218,7 +237,7 @@ func (s *ESAPIV7) UpdateIndexMapping(indexName string, settings map[string]inter
 		log.Error(url)
 		log.Error(body.String())
 		log.Error(err, res)
-		panic(err)
+		return err
 	}
 	//}
 	return nil
@@ -35,7 +35,7 @@ func (s *ESAPIV8) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	data, _ := json.Marshal(param)
 	reqData := bytes.NewBuffer(data)
 	url := fmt.Sprintf("%s/_search/scroll", s.Host)
-	body, err := Request(s.Compress, "GET", url, s.Auth, reqData, s.HttpProxy)
+	body, err := RequestNoReplay(s.Compress, "GET", url, s.Auth, reqData, s.HttpProxy)
 
 	if err != nil {
 		//log.Error(errs)